@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/wrouesnel/proxyreverse/assets"
 	"github.com/wrouesnel/proxyreverse/pkg/server"
@@ -25,7 +26,8 @@ type Options struct {
 		Format string `help:"logging format (${enum})" enum:"console,json" default:"console"`
 	} `embed:"" prefix:"logging."`
 
-	Config string `help:"File to load config from" default:"proxyreverse.yml"`
+	Config      string        `help:"File to load config from" default:"proxyreverse.yml"`
+	WatchConfig time.Duration `help:"Poll the config file for changes at this interval and reload it (0 disables)" default:"0s"`
 
 	Assets assets.Config `embed:"" prefix:"assets." help:"configure embedded asset handling"`
 
@@ -130,7 +132,9 @@ func Entrypoint(args LaunchArgs) int {
 	logger.Info("Starting command")
 	switch ctx.Command() {
 	case "reverse-proxy":
-		err = server.Server(appCtx, options.Assets, options.ReverseProxy, cfg)
+		reloads := make(chan *config.Config)
+		go watchConfig(appCtx, logger, options.Config, configBytes, options.WatchConfig, reloads)
+		err = server.Server(appCtx, options.Assets, options.ReverseProxy, cfg, reloads)
 	case "dump-config":
 		args.StdOut.Write([]byte(sanitizedCfg))
 	default:
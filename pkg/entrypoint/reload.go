@@ -0,0 +1,70 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+)
+
+// watchConfig reloads the config file when SIGHUP is received, and when its
+// content changes if pollInterval is not 0. Configurations which load
+// successfully are sent to reloads until ctx is cancelled.
+func watchConfig(ctx context.Context, logger *zap.Logger, path string, current []byte, pollInterval time.Duration,
+	reloads chan<- *config.Config,
+) {
+	sighupCh := make(chan os.Signal, 1)
+	signal.Notify(sighupCh, syscall.SIGHUP)
+	defer signal.Stop(sighupCh)
+
+	var pollCh <-chan time.Time
+	if pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		pollCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighupCh:
+			logger.Info("Caught signal, reloading configuration", zap.String("signal", syscall.SIGHUP.String()))
+		case <-pollCh:
+			configBytes, err := os.ReadFile(path)
+			if err != nil {
+				logger.Debug("Could not read config file while polling for changes", zap.Error(err))
+				continue
+			}
+			if bytes.Equal(configBytes, current) {
+				continue
+			}
+			logger.Info("Config file changed, reloading configuration")
+		}
+
+		configBytes, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error("Error loading config, keeping the running configuration", zap.Error(err))
+			continue
+		}
+		// Remember the content even if it is invalid so it is only reported once.
+		current = configBytes
+
+		cfg, err := config.Load(configBytes)
+		if err != nil {
+			logger.Error("Error loading config, keeping the running configuration", zap.Error(err))
+			continue
+		}
+
+		select {
+		case reloads <- cfg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
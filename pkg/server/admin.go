@@ -0,0 +1,379 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+)
+
+const (
+	adminMaxBodySize       = 1 << 20
+	adminReadHeaderTimeout = 10 * time.Second
+	// adminUnsavedWarning is sent with changes which are not written to the config file.
+	adminUnsavedWarning = `299 proxyreverse "site changes are not saved and are lost on the next configuration reload"`
+)
+
+var (
+	ErrAdminHostMismatch = errors.New("site host does not match the host in the request path")
+	ErrAdminNoConfig     = errors.New("no configuration is running")
+	ErrAdminUnauthorized = errors.New("a valid bearer token is required")
+)
+
+// ListenerStatus is the admin API view of a listener.
+type ListenerStatus struct {
+	Name       string   `json:"name"`
+	ListenAddr string   `json:"listen_addr"`
+	ListenType string   `json:"listen_type"`
+	Running    bool     `json:"running"`
+	Sites      []string `json:"sites"`
+}
+
+// SiteStatus is the admin API view of a site.
+type SiteStatus struct {
+	Host       string         `json:"host"`
+	Listeners  []string       `json:"listeners"`
+	Proxychain string         `json:"proxychain"`
+	Targets    []TargetStatus `json:"targets"`
+	// Unsaved is true if the site was changed through the admin API, so it is
+	// lost on the next configuration reload.
+	Unsaved bool `json:"unsaved,omitempty"`
+}
+
+// ProxychainStatus is the admin API view of a proxychain. Hops are shown with
+// their credentials redacted.
+type ProxychainStatus struct {
+	Name          string     `json:"name"`
+	Alternatives  [][]string `json:"alternatives"`
+	Rules         int        `json:"rules"`
+	DNSResolution string     `json:"dns_resolution,omitempty"`
+	Sites         []string   `json:"sites"`
+}
+
+// runningSiteStatus returns the status of a running site. s.mu must be held.
+func (s *serverState) runningSiteStatus(running *runningSite) SiteStatus {
+	status := SiteStatus{
+		Host:       running.cfg.Host,
+		Listeners:  append([]string{}, running.cfg.Listener...),
+		Proxychain: running.cfg.Proxychain,
+		Targets:    []TargetStatus{},
+		Unsaved:    s.adminChanged[running.cfg.Host],
+	}
+	if backend, ok := running.site.Handler.(*HTTPBackend); ok {
+		status.Targets = backend.TargetStatus()
+	}
+	return status
+}
+
+// listenerStatus returns the status of every configured listener.
+func (s *serverState) listenerStatus() []ListenerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []ListenerStatus{}
+	if s.cfg == nil {
+		return result
+	}
+	for name, listenerConfig := range s.cfg.Listeners {
+		status := ListenerStatus{
+			Name:       name,
+			ListenAddr: listenerConfig.ListenAddr.String(),
+			ListenType: string(listenerConfig.ListenerType),
+			Sites:      []string{},
+		}
+		_, status.Running = s.listeners[name]
+		for _, running := range s.sites {
+			if slices.Contains(running.cfg.Listener, name) {
+				status.Sites = append(status.Sites, running.cfg.Host)
+			}
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// siteStatus returns the status of every site.
+func (s *serverState) siteStatus() []SiteStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return lo.Map(s.sites, func(running *runningSite, _ int) SiteStatus { return s.runningSiteStatus(running) })
+}
+
+// proxychainStatus returns the status of every proxychain.
+func (s *serverState) proxychainStatus() []ProxychainStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []ProxychainStatus{}
+	for name, proxychainConfig := range s.proxychainConfigs {
+		status := ProxychainStatus{
+			Name:          name,
+			Alternatives:  [][]string{},
+			Rules:         len(proxychainConfig.Rules),
+			DNSResolution: string(proxychainConfig.DNS.Resolution),
+			Sites:         []string{},
+		}
+		for _, alternative := range proxychainConfig.Alternatives {
+			status.Alternatives = append(status.Alternatives, lo.Map(alternative, func(hop config.Proxy, _ int) string {
+				return hop.Proxy.Redacted()
+			}))
+		}
+		for _, running := range s.sites {
+			if running.cfg.Proxychain == name {
+				status.Sites = append(status.Sites, running.cfg.Host)
+			}
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// putSite adds the site loaded from siteData, replacing any sites for host. It
+// returns true if no site for host existed.
+func (s *serverState) putSite(host string, siteData []byte) (SiteStatus, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg == nil {
+		return SiteStatus{}, false, ErrAdminNoConfig
+	}
+
+	siteCfg, err := config.LoadSite(siteData, s.cfg)
+	if err != nil {
+		return SiteStatus{}, false, err
+	}
+	if siteCfg.Host == "" {
+		siteCfg.Host = host
+	}
+	if siteCfg.Host != host {
+		return SiteStatus{}, false, errors.Wrapf(ErrAdminHostMismatch, "%v", siteCfg.Host)
+	}
+
+	newCfg := *s.cfg
+	newCfg.Sites = lo.Reject(s.cfg.Sites, func(site config.SiteConfig, _ int) bool { return site.Host == host })
+	created := len(newCfg.Sites) == len(s.cfg.Sites)
+	newCfg.Sites = append(newCfg.Sites, siteCfg)
+
+	if err := s.applyLocked(&newCfg); err != nil {
+		return SiteStatus{}, false, err
+	}
+	s.adminChanged[host] = true
+
+	running, _ := lo.Find(s.sites, func(running *runningSite) bool { return running.cfg.Host == host })
+	return s.runningSiteStatus(running), created, nil
+}
+
+// removeSite detaches the sites for host from their listeners and stops them.
+func (s *serverState) removeSite(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed, kept := lo.FilterReject(s.sites, func(running *runningSite, _ int) bool { return running.cfg.Host == host })
+	if len(removed) == 0 {
+		return errors.Wrapf(ErrSiteNotFound, "%v", host)
+	}
+
+	for _, running := range removed {
+		for _, listenerName := range running.cfg.Listener {
+			if listener, found := s.listeners[listenerName]; found {
+				if err := listener.listener.RemoveSite(host); err != nil {
+					s.logger.Warn("Site was not attached to listener", zap.String("host", host),
+						zap.String("listener_name", listenerName), zap.Error(err))
+				}
+			}
+		}
+		running.cancel()
+	}
+
+	newCfg := *s.cfg
+	newCfg.Sites = lo.Reject(s.cfg.Sites, func(site config.SiteConfig, _ int) bool { return site.Host == host })
+	s.cfg = &newCfg
+	s.sites = kept
+	s.adminChanged[host] = true
+	return nil
+}
+
+// adminAPI serves the admin HTTP API. The bearer token is read from the running
+// configuration, so it can be changed by a reload.
+type adminAPI struct {
+	logger *zap.Logger
+	state  *serverState
+}
+
+// writeJSON writes value as the JSON response.
+func (a *adminAPI) writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		a.logger.Debug("Error writing admin API response", zap.Error(err))
+	}
+}
+
+// writeError writes err as a JSON error response.
+func (a *adminAPI) writeError(w http.ResponseWriter, status int, err error) {
+	a.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/listeners", func(w http.ResponseWriter, _ *http.Request) {
+		a.writeJSON(w, http.StatusOK, a.state.listenerStatus())
+	})
+	mux.HandleFunc("GET /api/v1/sites", func(w http.ResponseWriter, _ *http.Request) {
+		a.writeJSON(w, http.StatusOK, a.state.siteStatus())
+	})
+	mux.HandleFunc("GET /api/v1/proxychains", func(w http.ResponseWriter, _ *http.Request) {
+		a.writeJSON(w, http.StatusOK, a.state.proxychainStatus())
+	})
+	mux.HandleFunc("PUT /api/v1/sites/{host}", a.putSite)
+	mux.HandleFunc("DELETE /api/v1/sites/{host}", a.deleteSite)
+	mux.Handle("GET /metrics", a.state.metrics.handler())
+	return a.authenticate(mux)
+}
+
+// authenticate requires the bearer token on requests which didn't arrive on the
+// unix socket, which is protected by its permissions instead.
+func (a *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := a.state.adminToken()
+		if _, unix := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); unix || expected == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			a.logger.Info("Rejected unauthenticated admin API request",
+				zap.String("remote_addr", r.RemoteAddr), zap.String("path", r.URL.Path))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxyreverse"`)
+			a.writeError(w, http.StatusUnauthorized, ErrAdminUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// putSite adds or replaces a site.
+func (a *adminAPI) putSite(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, adminMaxBodySize))
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	status, created, err := a.state.putSite(host, body)
+	if err != nil {
+		a.logger.Info("Rejected site from admin API", zap.String("host", host), zap.Error(err))
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	a.logger.Info("Site updated from admin API", zap.String("host", host), zap.Bool("created", created))
+	w.Header().Set("Warning", adminUnsavedWarning)
+	if created {
+		a.writeJSON(w, http.StatusCreated, status)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, status)
+}
+
+// deleteSite removes a site.
+func (a *adminAPI) deleteSite(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	if err := a.state.removeSite(host); err != nil {
+		if errors.Is(err, ErrSiteNotFound) {
+			a.writeError(w, http.StatusNotFound, err)
+			return
+		}
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.logger.Info("Site removed from admin API", zap.String("host", host))
+	w.Header().Set("Warning", adminUnsavedWarning)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listenAdmin opens the listeners configured for the admin API.
+func listenAdmin(cfg config.AdminConfig) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	if cfg.ListenAddr.Port != 0 {
+		listener, err := net.Listen(cfg.ListenAddr.Network, cfg.ListenAddr.HostPort())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to start admin listener: %v", cfg.ListenAddr.String())
+		}
+		listeners = append(listeners, listener)
+	}
+	if cfg.Socket != "" {
+		// Remove a socket left behind by an unclean shutdown.
+		if info, err := os.Stat(cfg.Socket); err == nil && info.Mode().Type() == os.ModeSocket {
+			_ = os.Remove(cfg.Socket)
+		}
+		listener, err := net.Listen("unix", cfg.Socket)
+		if err == nil {
+			err = os.Chmod(cfg.Socket, 0o600)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			if listener != nil {
+				_ = listener.Close()
+			}
+			return nil, errors.Wrapf(err, "failed to start admin listener: %v", cfg.Socket)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// startAdminAPI serves the admin API if it is configured, until ctx is cancelled.
+func startAdminAPI(ctx context.Context, cfg config.AdminConfig, state *serverState) error {
+	listeners, err := listenAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return nil
+	}
+
+	api := &adminAPI{
+		logger: zap.L().With(zap.String("component", "admin")),
+		state:  state,
+	}
+	server := &http.Server{
+		Handler:           api.handler(),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+	}
+
+	for _, listener := range listeners {
+		api.logger.Info("Admin API listening", zap.String("addr", listener.Addr().String()))
+		go func(listener net.Listener) {
+			if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				api.logger.Error("Got error starting admin API server", zap.Error(err))
+			}
+		}(listener)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			api.logger.Error("Got error while closing admin API server", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
@@ -1,101 +1,379 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/imroc/req/v3"
+	"github.com/pkg/errors"
 	"github.com/wrouesnel/proxyreverse/pkg/server/config"
 	"go.uber.org/zap"
 )
 
 type HTTPBackend struct {
 	logger     *zap.Logger
-	client     *req.Client // client is the HTTP request client used to forward connections
-	proxychain Proxychain  // proxychain is the chain of proxies which connect to the system
+	transports *transportPool // transports caches the HTTP transports used to forward requests
+	proxychain Proxychain     // proxychain is the chain of proxies which connect to the system
+	tlsConfig  *tls.Config    // tlsConfig is the TLS client configuration used to connect to the backend
+	// dialContext connects to the backend through the proxychain within the connect timeout.
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 
 	target         string
 	port           uint16
 	tls            config.TLS
-	setHeaders     http.Header    // setHeaders ore the headers to set on the outbound request
-	delHeaders     []string       // delHeaders are the headers to delete on the outbound request
-	targetSelector TargetSelector // targetSelector implements the actual target backend selection logic
-}
+	setHeaders     http.Header            // setHeaders ore the headers to set on the outbound request
+	delHeaders     []string               // delHeaders are the headers to delete on the outbound request
+	forwarder      forwarder              // forwarder adds the client forwarding headers to the outbound request
+	hostHeader     hostHeader             // hostHeader selects the Host header sent to the backend
+	rewriter       responseRewriter       // rewriter maps backend origins in responses to the public site
+	retry          retryPolicy            // retry decides whether failed requests are retried
+	flushInterval  time.Duration          // flushInterval is the interval between response flushes to the client
+	timeouts       config.BackendTimeouts // timeouts are the timeouts of requests to the backend
+	targetSelector TargetSelector         // targetSelector implements the actual target backend selection logic
 
-func NewHTTPBackend(config config.BackendConfig, proxychain Proxychain) (*HTTPBackend, error) {
-	client := req.NewClient().
-		SetDial(proxychain.Dialer().DialContext)
+	targetAddrs       []string                 // targetAddrs are the configured targets
+	health            *healthTracker           // health tracks the health of the configured targets
+	breakers          circuitBreakers          // breakers fail requests fast to targets which keep failing
+	healthCheckConfig config.ActiveHealthCheck // healthCheckConfig configures active health checks
+}
 
+// NewHTTPBackend initializes an HTTPBackend. Background tasks such as health
+// checks run until ctx is cancelled.
+func NewHTTPBackend(ctx context.Context, config config.BackendConfig, proxychain Proxychain) (*HTTPBackend, error) {
 	sniName := config.Target.Host
 	if config.TLS.ServerNameIndication != nil {
 		sniName = *config.TLS.ServerNameIndication
 	}
 
-	if config.TLS.Enable {
-		client = client.SetTLSClientConfig(&tls.Config{
-			InsecureSkipVerify: config.TLS.NoVerify,
-			ServerName:         sniName,
-			RootCAs:            config.TLS.CACerts.CertPool,
+	//nolint:gosec
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLS.NoVerify,
+		ServerName:         sniName,
+		RootCAs:            config.TLS.CACerts.CertPool,
+	}
+
+	// Connections to the backend are bounded by the connect timeout.
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := withTimeout(ctx, config.Timeouts.Connect)
+		defer cancel()
+		return proxychain.Dialer().DialContext(ctx, network, addr)
+	}
+	transports := newTransportPool(config.ConnectionPool.MaxTransports, config.ConnectionPool.IdleTimeout,
+		func(key transportKey) *http.Transport {
+			transport := &http.Transport{
+				DialContext:           dialContext,
+				TLSHandshakeTimeout:   enabledTimeout(config.Timeouts.TLSHandshake),
+				ResponseHeaderTimeout: enabledTimeout(config.Timeouts.ResponseHeader),
+				ForceAttemptHTTP2:     true,
+				// Responses are passed through to the client unmodified.
+				DisableCompression: true,
+			}
+			if config.TLS.Enable {
+				transport.TLSClientConfig = tlsConfig.Clone()
+				transport.TLSClientConfig.ServerName = key.ServerName
+			}
+			return transport
 		})
+
+	hostHeader, err := newHostHeader(config.HostHeader)
+	if err != nil {
+		return nil, err
 	}
 
-	targetSelector := NewTargetSelector(config.TargetSelect, config.TargetSelectParams)
+	targetSelector := NewTargetSelector(config.TargetSelect, config.TargetSelectParams, config.Targets)
 	if targetSelector == nil {
 		return nil, fmt.Errorf("invalid target_select specification")
 	}
 
 	r := &HTTPBackend{
-		client:     client,
+		transports: transports,
 		proxychain: proxychain,
+		tlsConfig:  tlsConfig,
 
 		target:         config.Target.Host,
 		port:           config.Target.Port,
 		tls:            config.TLS,
 		setHeaders:     config.HTTPHeaders.SetHeaders,
 		delHeaders:     config.HTTPHeaders.DelHeaders,
+		forwarder:      forwarder{cfg: config.ForwardedHeaders},
+		hostHeader:     hostHeader,
+		rewriter:       responseRewriter{cfg: config.ResponseRewrite},
+		retry:          retryPolicy{cfg: config.Retry},
+		flushInterval:  config.FlushInterval,
+		timeouts:       config.Timeouts,
+		dialContext:    dialContext,
 		targetSelector: targetSelector,
+
+		healthCheckConfig: config.HealthCheck.Active,
 	}
 	r.logger = zap.L().With(zap.String("target", config.Target.String()))
 
+	// Health and circuit breakers are tracked for the configured targets.
+	targetAddrs := make([]string, 0, len(config.Targets))
+	for _, target := range config.Targets {
+		targetAddrs = append(targetAddrs, target.Target.HostPort())
+	}
+	if len(targetAddrs) == 0 && config.Target.Host != "" {
+		targetAddrs = append(targetAddrs, config.Target.HostPort())
+	}
+	r.targetAddrs = targetAddrs
+	r.health = newHealthTracker(config.HealthCheck, targetAddrs)
+	r.health.Start(ctx, r.healthCheck)
+	r.breakers = newCircuitBreakers(config.CircuitBreaker, targetAddrs)
+
 	return r, nil
 }
 
+// TargetStatus is the state of a configured backend target.
+type TargetStatus struct {
+	Addr    string `json:"addr"`
+	Healthy bool   `json:"healthy"`
+	Circuit string `json:"circuit"`
+}
+
+// TargetStatus returns the state of the configured targets.
+func (h *HTTPBackend) TargetStatus() []TargetStatus {
+	status := make([]TargetStatus, 0, len(h.targetAddrs))
+	for _, addr := range h.targetAddrs {
+		status = append(status, TargetStatus{
+			Addr:    addr,
+			Healthy: h.health.Healthy(addr),
+			Circuit: h.breakers.Get(addr).State().String(),
+		})
+	}
+	return status
+}
+
 // ServerHTTP implements http.Handler.
 func (h HTTPBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// Bound the whole request unless it is an upgrade, which may be long-lived.
+	if !isUpgradeRequest(request) {
+		ctx, cancel := withTimeout(request.Context(), h.timeouts.Request)
+		defer cancel()
+		request = request.WithContext(ctx)
+	}
+
 	// Receive the request, copy headers and make the outbound request.
-	outbound := h.client.NewRequest()
-	outbound.Method = request.Method
-	outbound.Headers = request.Header
+	outbound := request.Clone(request.Context())
+	// Remove connection specific headers
+	removeRequestHopByHopHeaders(outbound.Header)
+	// Choose the Host header
+	if host := h.hostHeader.get(request); host != "" {
+		outbound.Header.Set("Host", host)
+	}
+	// Add client forwarding information
+	h.forwarder.apply(outbound, request)
 	// Set headers
 	for k, v := range h.setHeaders {
-		outbound.Headers[k] = v
+		outbound.Header[k] = v
 	}
 	// Delete headers we don't want
 	for _, k := range h.delHeaders {
-		delete(outbound.Headers, k)
+		delete(outbound.Header, k)
+	}
+	// Don't let the transport add a default User-Agent
+	if _, found := outbound.Header["User-Agent"]; !found {
+		outbound.Header.Set("User-Agent", "")
 	}
 
-	scheme := "http"
-	if h.tls.Enable {
-		scheme = "https"
+	originalPath := request.URL.Path
+
+	rm := requestMetricsFrom(request.Context())
+
+	if isUpgradeRequest(request) {
+		target, release := h.selectTarget(request)
+		defer release()
+		rm.selection(h.metricsTarget(target), selectionSelected)
+		targetHost, _, _ := net.SplitHostPort(target)
+		h.serveUpgrade(writer, request, outbound.Header, h.outboundURL(request, target), targetHost)
+		return
 	}
 
-	// Get the target name
-	target := h.targetSelector.GetTarget(h, request)
+	outbound.RequestURI = ""
+	outbound.Host = outbound.Header.Get("Host")
+	outbound.Close = false
+	// The body is streamed exactly once unless it is buffered for retries.
+	outbound.GetBody = nil
+	if request.ContentLength == 0 {
+		outbound.Body = nil
+	}
+	// Share the trailer map so trailers are available once the body is read.
+	outbound.Trailer = request.Trailer
+
+	replayable := h.retry.prepareBody(outbound)
+
+	// Do the outbound request, retrying if the policy allows it.
+	var resp *http.Response
+	var target string
+	var triedTargets []string
+	for attempt := 1; ; attempt++ {
+		// Selectors may modify the path so always start from the original.
+		request.URL.Path = originalPath
+		var release func()
+		target, release = h.selectTarget(request.WithContext(withExcludedTargets(request.Context(), triedTargets)))
+		triedTargets = append(triedTargets, target)
+
+		// The transport may still be reading a failed request, so every attempt
+		// is sent as a new request.
+		attemptRequest := outbound.Clone(outbound.Context())
+		attemptRequest.URL = h.outboundURL(request, target)
+		attemptRequest.Trailer = outbound.Trailer
+		if replayable {
+			attemptRequest.Body, _ = outbound.GetBody()
+		}
+
+		if target == "" {
+			rm.selection(h.metricsTarget(target), selectionNoTarget)
+		}
+		breaker := h.breakers.Get(target)
+		if err := breaker.Allow(); err != nil {
+			rm.selection(h.metricsTarget(target), selectionCircuitOpen)
+			release()
+			h.logger.Debug("Circuit breaker is open", zap.String("target_addr", target), zap.Error(err))
+			writeCircuitOpenPage(writer, breaker.RetryAfter())
+			return
+		}
+
+		switch {
+		case target == "":
+		case attempt == 1:
+			rm.selection(h.metricsTarget(target), selectionSelected)
+		default:
+			rm.selection(h.metricsTarget(target), selectionRetry)
+		}
+
+		var err error
+		resp, err = h.transports.Get(h.transportKey(target)).RoundTrip(attemptRequest)
+		if err != nil {
+			release()
+			h.logger.Debug("Error contacting backend", zap.String("target_addr", target),
+				zap.Int("attempt", attempt), zap.Error(err))
+			if errors.Is(err, ErrCircuitOpen) {
+				// A proxy in the chain is failing, not the backend.
+				breaker.Release()
+				writeCircuitOpenPage(writer, 0)
+				return
+			}
+			if errors.Is(request.Context().Err(), context.Canceled) {
+				// The client went away, which says nothing about the target. The
+				// request timeout expiring does, since the target is hanging.
+				breaker.Release()
+			} else {
+				breaker.Failure()
+				h.health.ReportFailure(target)
+			}
+			if h.retry.retryOnError() && h.retry.canRetry(outbound, replayable, attempt) &&
+				h.retry.wait(request.Context(), attempt) == nil {
+				continue
+			}
+			writer.WriteHeader(backendErrorStatus(err))
+			return
+		}
+
+		if breaker.IsFailureStatus(resp.StatusCode) {
+			breaker.Failure()
+		} else {
+			breaker.Success()
+		}
+		if h.health.IsFailureStatus(resp.StatusCode) {
+			h.health.ReportFailure(target)
+		} else {
+			h.health.ReportSuccess(target)
+		}
+
+		if h.retry.retryOnStatus(resp.StatusCode) && h.retry.canRetry(outbound, replayable, attempt) {
+			h.logger.Debug("Retrying backend request", zap.String("target_addr", target),
+				zap.Int("attempt", attempt), zap.Int("status", resp.StatusCode))
+			discardResponse(resp)
+			release()
+			if h.retry.wait(request.Context(), attempt) == nil {
+				continue
+			}
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer release()
+		break
+	}
+	defer resp.Body.Close()
 	targetHost, _, _ := net.SplitHostPort(target)
 
-	if h.target == "" && h.tls.Enable {
-		// Need to set SNI name per request if no specified target
-		tlsConfig := h.client.GetTLSClientConfig()
-		tlsConfig.ServerName = targetHost
-		h.client.SetTLSClientConfig(tlsConfig)
+	// Read response headers
+	removeHopByHopHeaders(resp.Header)
+	if h.rewriter.enabled() {
+		h.rewriter.apply(resp.Header, h.rewriteContext(request, outbound, targetHost, originalPath))
+	}
+	headerMap := writer.Header()
+	for k, v := range resp.Header {
+		headerMap[k] = v
 	}
 
-	outboundURL := url.URL{
+	// Announce trailers so they can be sent after the body.
+	announcedTrailers := len(resp.Trailer)
+	if announcedTrailers > 0 {
+		trailerKeys := make([]string, 0, announcedTrailers)
+		for k := range resp.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		headerMap.Add("Trailer", strings.Join(trailerKeys, ", "))
+	}
+
+	// Write response headers
+	writer.WriteHeader(resp.StatusCode)
+	// Copy response body from host to destination
+	if err := copyResponse(writer, resp.Body, h.responseFlushInterval(resp)); err != nil {
+		h.logger.Debug("Error copying response body", zap.Error(err))
+		return
+	}
+
+	// Write trailers
+	if len(resp.Trailer) == announcedTrailers {
+		for k, v := range resp.Trailer {
+			headerMap[k] = v
+		}
+		return
+	}
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			headerMap.Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// selectTarget chooses the backend target for the request. The returned release
+// function must be called once the request to the target is finished.
+func (h HTTPBackend) selectTarget(request *http.Request) (string, func()) {
+	target := h.targetSelector.GetTarget(h, request)
+	if releaser, ok := h.targetSelector.(TargetReleaser); ok {
+		return target, func() { releaser.ReleaseTarget(target) }
+	}
+	return target, func() {}
+}
+
+// metricsTarget returns the metrics label of target. Targets which are not
+// configured share one label, so clients can't create new series.
+func (h HTTPBackend) metricsTarget(target string) string {
+	if target == "" || slices.Contains(h.targetAddrs, target) {
+		return target
+	}
+	return dynamicTargetLabel
+}
+
+// outboundURL builds the URL of the request to target.
+func (h HTTPBackend) outboundURL(request *http.Request, target string) *url.URL {
+	scheme := "http"
+	if h.tls.Enable {
+		scheme = "https"
+	}
+
+	return &url.URL{
 		Scheme:      scheme,
 		User:        request.URL.User,
 		Host:        target,
@@ -103,29 +381,62 @@ func (h HTTPBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request
 		RawQuery:    request.URL.RawQuery,
 		RawFragment: request.URL.RawFragment,
 	}
-	outbound.RawURL = outboundURL.String()
-	outbound.GetBody = func() (io.ReadCloser, error) {
-		return request.Body, nil
+}
+
+// transportKey returns the transport pool key used to connect to target.
+func (h HTTPBackend) transportKey(target string) transportKey {
+	key := transportKey{Addr: target}
+	if h.tls.Enable {
+		key.ServerName = h.tlsConfig.ServerName
+		if h.target == "" && h.tls.ServerNameIndication == nil {
+			// Need to set SNI name per request if no specified target, unless
+			// sni_name is configured
+			key.ServerName, _, _ = net.SplitHostPort(target)
+		}
+	}
+	return key
+}
+
+// responseFlushInterval returns the flush interval to use for the response.
+// Event streams and responses of unknown length are always flushed immediately,
+// as httputil.ReverseProxy does, since they may be streamed indefinitely.
+func (h HTTPBackend) responseFlushInterval(resp *http.Response) time.Duration {
+	contentType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if strings.EqualFold(strings.TrimSpace(contentType), "text/event-stream") || resp.ContentLength == -1 {
+		return -1
 	}
+	return h.flushInterval
+}
 
-	// Do the outbound request
-	resp := outbound.Do(request.Context())
+// rewriteContext builds the information needed to rewrite responses back to the
+// public site.
+func (h HTTPBackend) rewriteContext(request *http.Request, outbound *http.Request, targetHost string,
+	originalPath string) rewriteContext {
+	publicScheme := "http"
+	if request.TLS != nil {
+		publicScheme = "https"
+	}
 
-	// Read response headers
-	headerMap := writer.Header()
-	if resp.Response == nil {
-		h.logger.Debug("Error contacting backend", zap.Error(resp.Err))
-		writer.WriteHeader(http.StatusBadGateway)
-		return
+	backendHosts := []string{targetHost}
+	if outbound.Host != "" {
+		if host, _, err := net.SplitHostPort(outbound.Host); err == nil {
+			backendHosts = append(backendHosts, host)
+		} else {
+			backendHosts = append(backendHosts, outbound.Host)
+		}
 	}
 
-	if resp.Response.Header != nil {
-		for k, v := range resp.Response.Header {
-			headerMap[k] = v
+	mapPath := func(backendPath string) string { return backendPath }
+	if mapper, ok := h.targetSelector.(PathMapper); ok {
+		mapPath = func(backendPath string) string {
+			return mapper.PublicPath(originalPath, backendPath)
 		}
 	}
-	// Write response headers
-	writer.WriteHeader(resp.StatusCode)
-	// Copy response body from host to destination
-	io.Copy(writer, resp.Response.Body)
+
+	return rewriteContext{
+		publicScheme: publicScheme,
+		publicHost:   request.Host,
+		backendHosts: backendHosts,
+		mapPath:      mapPath,
+	}
 }
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultCircuitOpenDuration     = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker stops requests to a failing destination. After FailureThreshold
+// consecutive failures the circuit opens and requests fail fast. Once
+// OpenDuration has passed the circuit is half-open and a limited number of trial
+// requests are let through - if they all succeed the circuit closes again,
+// otherwise it re-opens.
+type circuitBreaker struct {
+	logger *zap.Logger
+	name   string
+	cfg    config.CircuitBreaker
+
+	mu                sync.Mutex
+	state             CircuitState
+	failures          uint
+	openedAt          time.Time
+	halfOpenInFlight  uint
+	halfOpenSuccesses uint
+}
+
+// newCircuitBreaker returns a circuit breaker, or nil if it is not configured.
+// All methods are safe to call on a nil circuitBreaker.
+func newCircuitBreaker(name string, cfg config.CircuitBreaker) *circuitBreaker {
+	if cfg.FailureThreshold == 0 {
+		return nil
+	}
+	if cfg.OpenDuration == 0 {
+		cfg.OpenDuration = defaultCircuitOpenDuration
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+	circuitBreakerState.WithLabelValues(name).Set(float64(CircuitClosed))
+	return &circuitBreaker{
+		logger: zap.L().With(zap.String("circuit_breaker", name)),
+		name:   name,
+		cfg:    cfg,
+	}
+}
+
+// setState changes state and logs the transition. Must be called with the lock held.
+func (b *circuitBreaker) setState(state CircuitState) {
+	if b.state == state {
+		return
+	}
+	b.logger.Warn("Circuit breaker state changed",
+		zap.String("from", b.state.String()), zap.String("to", state.String()))
+	b.state = state
+	circuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+	b.halfOpenInFlight = 0
+	b.halfOpenSuccesses = 0
+	if state == CircuitOpen {
+		b.openedAt = time.Now()
+	}
+	if state == CircuitClosed {
+		b.failures = 0
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Ready returns true if a request would currently be allowed. Unlike Allow it
+// does not reserve a half-open trial request.
+func (b *circuitBreaker) Ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		return time.Since(b.openedAt) >= b.cfg.OpenDuration
+	case CircuitHalfOpen:
+		return b.halfOpenInFlight < b.cfg.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// RetryAfter returns how long until the open circuit allows trial requests.
+func (b *circuitBreaker) RetryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != CircuitOpen {
+		return 0
+	}
+	return max(b.cfg.OpenDuration-time.Since(b.openedAt), 0)
+}
+
+// Allow returns ErrCircuitOpen if a request must not be made. Otherwise the
+// result of the request must be reported with Success, Failure or Release.
+func (b *circuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitOpen {
+		if time.Since(b.openedAt) < b.cfg.OpenDuration {
+			return errors.Wrapf(ErrCircuitOpen, "%v", b.name)
+		}
+		b.setState(CircuitHalfOpen)
+	}
+
+	if b.state == CircuitHalfOpen {
+		if b.halfOpenInFlight >= b.cfg.HalfOpenRequests {
+			return errors.Wrapf(ErrCircuitOpen, "%v", b.name)
+		}
+		b.halfOpenInFlight++
+	}
+	return nil
+}
+
+// Release gives back a request allowed by Allow without recording a result, for
+// example because the request was cancelled by the client.
+func (b *circuitBreaker) Release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitHalfOpen && b.halfOpenInFlight > 0 {
+		b.halfOpenInFlight--
+	}
+}
+
+// Success records a successful request.
+func (b *circuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitHalfOpen:
+		b.halfOpenSuccesses++
+		if b.halfOpenSuccesses >= b.cfg.HalfOpenRequests {
+			b.setState(CircuitClosed)
+		}
+	case CircuitClosed:
+		b.failures = 0
+	case CircuitOpen:
+	}
+}
+
+// Failure records a failed request.
+func (b *circuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitHalfOpen:
+		b.setState(CircuitOpen)
+	case CircuitClosed:
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.setState(CircuitOpen)
+		}
+	case CircuitOpen:
+	}
+}
+
+// IsFailureStatus returns true if the response status counts as a failure.
+func (b *circuitBreaker) IsFailureStatus(status int) bool {
+	if b == nil {
+		return false
+	}
+	return slices.Contains(b.cfg.FailureStatus, status)
+}
+
+// circuitBreakers holds the breakers for the configured targets of a backend.
+type circuitBreakers map[string]*circuitBreaker
+
+func newCircuitBreakers(cfg config.CircuitBreaker, addrs []string) circuitBreakers {
+	if cfg.FailureThreshold == 0 {
+		return nil
+	}
+	breakers := make(circuitBreakers)
+	for _, addr := range addrs {
+		breakers[addr] = newCircuitBreaker(fmt.Sprintf("target:%s", addr), cfg)
+	}
+	return breakers
+}
+
+// Get returns the breaker for addr, or nil if it has none.
+func (c circuitBreakers) Get(addr string) *circuitBreaker {
+	return c[addr]
+}
+
+// breakerDialer reports the results of dials through dialer to a breaker.
+type breakerDialer struct {
+	dialer  proxy.Dialer
+	breaker *circuitBreaker
+}
+
+// Dial implements proxy.Dialer.
+func (d *breakerDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer.
+func (d *breakerDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := d.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialForward(ctx, d.dialer, network, addr)
+	if err != nil {
+		// Cancellation by the client says nothing about the destination, but a
+		// connect timeout expiring is how a blackholed hop fails.
+		if errors.Is(ctx.Err(), context.Canceled) {
+			d.breaker.Release()
+		} else {
+			d.breaker.Failure()
+		}
+		return nil, err
+	}
+	d.breaker.Success()
+	return conn, nil
+}
+
+// writeCircuitOpenPage writes the fast-fail response used while a circuit is open.
+// The breaker error names internal addresses, so callers log it instead of
+// sending it to the client.
+func writeCircuitOpenPage(writer http.ResponseWriter, retryAfter time.Duration) {
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	if retryAfter > 0 {
+		writer.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Round(time.Second).Seconds())))
+	}
+	writer.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = fmt.Fprintf(writer, "%d %s\n\nThe backend is temporarily unavailable because it has failed repeatedly "+
+		"and its circuit breaker is open. Please try again later.\n",
+		http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+// blackholeDialer never connects, like a hop whose packets are dropped.
+type blackholeDialer struct{}
+
+func (blackholeDialer) Dial(network, addr string) (net.Conn, error) {
+	return blackholeDialer{}.DialContext(context.Background(), network, addr)
+}
+
+func (blackholeDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestBreakerDialerOpensOnConnectTimeout(t *testing.T) {
+	breaker := newCircuitBreaker("test", config.CircuitBreaker{FailureThreshold: 2})
+	dialer := newTimeoutDialer(&breakerDialer{dialer: blackholeDialer{}, breaker: breaker}, 20*time.Millisecond)
+
+	for range 2 {
+		if _, err := dialForward(context.Background(), dialer, "tcp", "192.0.2.1:3128"); err == nil {
+			t.Fatal("expected the dial to time out")
+		}
+	}
+	if state := breaker.State(); state != CircuitOpen {
+		t.Errorf("expected connect timeouts to open the circuit, got %v", state)
+	}
+}
+
+func TestBreakerDialerIgnoresCancellation(t *testing.T) {
+	breaker := newCircuitBreaker("test", config.CircuitBreaker{FailureThreshold: 1})
+	dialer := &breakerDialer{dialer: blackholeDialer{}, breaker: breaker}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := dialer.DialContext(ctx, "tcp", "192.0.2.1:3128"); err == nil {
+		t.Fatal("expected the dial to be cancelled")
+	}
+	if state := breaker.State(); state != CircuitClosed {
+		t.Errorf("expected a cancelled dial to leave the circuit closed, got %v", state)
+	}
+}
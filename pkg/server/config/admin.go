@@ -0,0 +1,69 @@
+package config
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrAdminTokenRequired = errors.New("admin API on a non-loopback address requires a token")
+	ErrAdminTokenEmpty    = errors.New("admin API token is empty")
+)
+
+// AdminConfig configures the admin API. It is disabled unless an address or
+// socket is set.
+type AdminConfig struct {
+	ListenAddr HostSpec `mapstructure:"listen_addr,omitempty"` // ListenAddr is the TCP address to serve the admin API on
+	Socket     string   `mapstructure:"socket,omitempty"`      // Socket is the path of a unix socket to serve the admin API on
+	TokenFile  string   `mapstructure:"token_file,omitempty"`  // TokenFile is a file containing the bearer token for the TCP address
+	TokenEnv   string   `mapstructure:"token_env,omitempty"`   // TokenEnv is an environment variable containing the bearer token
+
+	token string
+}
+
+// Token returns the bearer token required on the TCP address, or an empty
+// string if none is configured.
+func (a AdminConfig) Token() string {
+	return a.token
+}
+
+// loopback returns true if the TCP address only accepts local connections.
+func (a AdminConfig) loopback() bool {
+	host := a.ListenAddr.Host
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// resolveToken reads the configured bearer token.
+func (a *AdminConfig) resolveToken() error {
+	var err error
+	switch {
+	case a.TokenFile != "":
+		a.token, err = readSecretFile(a.TokenFile)
+	case a.TokenEnv != "":
+		a.token, err = readSecretEnv(a.TokenEnv)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if a.token == "" {
+		return ErrAdminTokenEmpty
+	}
+	return nil
+}
+
+// validateAdmin checks the admin API can't be reached from other hosts without
+// a token. The unix socket is protected by its permissions instead.
+func (c *Config) validateAdmin() error {
+	if c.Admin.ListenAddr.Port == 0 || c.Admin.token != "" || c.Admin.loopback() {
+		return nil
+	}
+	return errors.Wrapf(ErrAdminTokenRequired, "%v", c.Admin.ListenAddr.String())
+}
@@ -0,0 +1,331 @@
+package config
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const RedactedValue = "REDACTED"
+
+var (
+	ErrCredentialEnvNotSet = errors.New("credential environment variable is not set")
+	ErrNetrcNoMachine      = errors.New("no matching machine in netrc file")
+	ErrPasswordWithoutUser = errors.New("proxy password configured without a username")
+)
+
+// ProxyCredentials configures where the credentials for a proxy are read from.
+// Credentials are resolved when the config is loaded, and take precedence over
+// any embedded in the proxy URL.
+type ProxyCredentials struct {
+	Username     string `mapstructure:"username,omitempty"`      // Username is the username to authenticate with
+	UsernameFile string `mapstructure:"username_file,omitempty"` // UsernameFile is a file containing the username
+	UsernameEnv  string `mapstructure:"username_env,omitempty"`  // UsernameEnv is an environment variable containing the username
+	PasswordFile string `mapstructure:"password_file,omitempty"` // PasswordFile is a file containing the password
+	PasswordEnv  string `mapstructure:"password_env,omitempty"`  // PasswordEnv is an environment variable containing the password
+	Netrc        string `mapstructure:"netrc,omitempty"`         // Netrc is a netrc file to look up the proxy host in
+
+	resolved *url.Userinfo
+}
+
+// configured returns true if any credential source is set.
+func (c ProxyCredentials) configured() bool {
+	return c.Username != "" || c.UsernameFile != "" || c.UsernameEnv != "" ||
+		c.PasswordFile != "" || c.PasswordEnv != "" || c.Netrc != ""
+}
+
+// readSecretFile reads a credential from a file, ignoring trailing newlines.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read credential file: %s", path)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// readSecretEnv reads a credential from an environment variable.
+func readSecretEnv(name string) (string, error) {
+	value, found := os.LookupEnv(name)
+	if !found {
+		return "", errors.Wrapf(ErrCredentialEnvNotSet, "%s", name)
+	}
+	return value, nil
+}
+
+// lookupNetrc returns the login and password for machine from a netrc file. The
+// default entry is used if the machine is not listed.
+func lookupNetrc(path string, machine string) (string, string, error) {
+	if rest, found := strings.CutPrefix(path, "~/"); found {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", errors.Wrap(err, "could not expand netrc path")
+		}
+		path = filepath.Join(home, rest)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "could not read netrc file: %s", path)
+	}
+	defer f.Close()
+
+	type netrcEntry struct {
+		login    string
+		password string
+	}
+	var matched, fallback *netrcEntry
+	var current *netrcEntry
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+scan:
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine":
+			current = nil
+			if scanner.Scan() && scanner.Text() == machine && matched == nil {
+				matched = new(netrcEntry)
+				current = matched
+			}
+		case "default":
+			current = nil
+			if fallback == nil {
+				fallback = new(netrcEntry)
+				current = fallback
+			}
+		case "login":
+			if scanner.Scan() && current != nil {
+				current.login = scanner.Text()
+			}
+		case "password":
+			if scanner.Scan() && current != nil {
+				current.password = scanner.Text()
+			}
+		case "account":
+			scanner.Scan()
+		case "macdef":
+			// Macro definitions are not supported so stop parsing here.
+			break scan
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", errors.Wrapf(err, "could not parse netrc file: %s", path)
+	}
+
+	if matched == nil {
+		matched = fallback
+	}
+	if matched == nil {
+		return "", "", errors.Wrapf(ErrNetrcNoMachine, "%s: %s", path, machine)
+	}
+	return matched.login, matched.password, nil
+}
+
+// resolve reads the configured credentials for the proxy at host. The username
+// from the proxy URL is used if no other username is configured.
+func (c *ProxyCredentials) resolve(host string, urlUsername string) error {
+	var username, password string
+	var hasPassword bool
+
+	if c.Netrc != "" {
+		login, netrcPassword, err := lookupNetrc(c.Netrc, host)
+		if err != nil {
+			return err
+		}
+		username, password, hasPassword = login, netrcPassword, netrcPassword != ""
+	}
+
+	var err error
+	switch {
+	case c.Username != "":
+		username = c.Username
+	case c.UsernameFile != "":
+		username, err = readSecretFile(c.UsernameFile)
+	case c.UsernameEnv != "":
+		username, err = readSecretEnv(c.UsernameEnv)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.PasswordFile != "":
+		password, err = readSecretFile(c.PasswordFile)
+		hasPassword = true
+	case c.PasswordEnv != "":
+		password, err = readSecretEnv(c.PasswordEnv)
+		hasPassword = true
+	}
+	if err != nil {
+		return err
+	}
+
+	if username == "" {
+		username = urlUsername
+	}
+	if username == "" {
+		if hasPassword {
+			return ErrPasswordWithoutUser
+		}
+		return nil
+	}
+	if hasPassword {
+		c.resolved = url.UserPassword(username, password)
+	} else {
+		c.resolved = url.User(username)
+	}
+	return nil
+}
+
+// ResolveCredentials reads the credentials configured for the proxy.
+func (p *Proxy) ResolveCredentials() error {
+	if !p.Credentials.configured() {
+		return nil
+	}
+	proxyURL, err := url.Parse(string(p.Proxy))
+	if err != nil {
+		return errors.Wrap(err, "ResolveCredentials")
+	}
+	if err := p.Credentials.resolve(proxyURL.Hostname(), proxyURL.User.Username()); err != nil {
+		return errors.Wrapf(err, "credentials for proxy %s", p.Proxy.Redacted())
+	}
+	return nil
+}
+
+// URL returns the proxy URL with any configured credentials applied.
+func (p Proxy) URL() (*url.URL, error) {
+	proxyURL, err := url.Parse(string(p.Proxy))
+	if err != nil {
+		return nil, errors.Wrap(err, "Proxy.URL")
+	}
+	if p.Credentials.resolved != nil {
+		proxyURL.User = p.Credentials.resolved
+	}
+	return proxyURL, nil
+}
+
+// Redacted returns the proxy URL with any password replaced so it is safe to log.
+func (p ProxyURL) Redacted() string {
+	proxyURL, err := url.Parse(string(p))
+	if err != nil || proxyURL.User == nil {
+		return string(p)
+	}
+	if _, hasPassword := proxyURL.User.Password(); hasPassword {
+		proxyURL.User = url.UserPassword(proxyURL.User.Username(), RedactedValue)
+	}
+	return proxyURL.String()
+}
+
+// Endpoint returns the scheme and address of the proxy URL without any
+// credentials, so it is safe to use as a metrics label. Values which aren't
+// URLs, such as pac, are returned unchanged.
+func (p ProxyURL) Endpoint() string {
+	proxyURL, err := url.Parse(string(p))
+	if err != nil {
+		return RedactedValue
+	}
+	if proxyURL.Host == "" {
+		if proxyURL.User != nil {
+			return RedactedValue
+		}
+		return string(p)
+	}
+	return proxyURL.Scheme + "://" + proxyURL.Host
+}
+
+// resolveCredentials resolves the credentials of all proxies in the config.
+func (c *Config) resolveCredentials() error {
+	for name, proxychain := range c.Proxychains {
+		for _, alternative := range proxychain.Alternatives {
+			for idx := range alternative {
+				if err := alternative[idx].ResolveCredentials(); err != nil {
+					return errors.Wrapf(err, "proxychain %s", name)
+				}
+			}
+		}
+		for ruleIdx, rule := range proxychain.Rules {
+			for idx := range rule.Via {
+				if err := rule.Via[idx].ResolveCredentials(); err != nil {
+					return errors.Wrapf(err, "proxychain %s rule %d", name, ruleIdx)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sanitizeProxychains redacts credentials and private keys in the proxychains of a config map.
+func sanitizeProxychains(configMap map[string]interface{}) {
+	proxychains, ok := configMap["proxychains"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	sanitizeHops := func(hops interface{}) {
+		hopList, ok := hops.([]interface{})
+		if !ok {
+			return
+		}
+		for _, hop := range hopList {
+			hopMap, ok := hop.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if proxyURL, ok := hopMap["proxy"].(string); ok {
+				hopMap["proxy"] = ProxyURL(proxyURL).Redacted()
+			}
+			if tlsMap, ok := hopMap["tls"].(map[string]interface{}); ok {
+				sanitizeKeyPair(tlsMap["client_certificate"])
+			}
+		}
+	}
+
+	for _, proxychain := range proxychains {
+		switch v := proxychain.(type) {
+		case []interface{}:
+			sanitizeHops(v)
+		case map[string]interface{}:
+			if alternatives, ok := v["alternatives"].([]interface{}); ok {
+				for _, alternative := range alternatives {
+					sanitizeHops(alternative)
+				}
+			}
+			if rules, ok := v["rules"].([]interface{}); ok {
+				for _, rule := range rules {
+					if ruleMap, ok := rule.(map[string]interface{}); ok {
+						sanitizeHops(ruleMap["via"])
+					}
+				}
+			}
+		}
+	}
+}
+
+// sanitizeSites redacts the inline private keys of site certificates.
+func sanitizeSites(configMap map[string]interface{}) {
+	sites, ok := configMap["sites"].([]interface{})
+	if !ok {
+		return
+	}
+	for _, site := range sites {
+		if siteMap, ok := site.(map[string]interface{}); ok {
+			sanitizeKeyPair(siteMap["certificate"])
+		}
+	}
+}
+
+// sanitizeKeyPair redacts the key of a TLS key pair if it is an inline private
+// key. Filenames are left alone.
+func sanitizeKeyPair(keyPair interface{}) {
+	keyPairMap, ok := keyPair.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if key, ok := keyPairMap["key"].(string); ok && strings.Contains(key, "PRIVATE KEY") {
+		keyPairMap["key"] = RedactedValue
+	}
+}
@@ -20,7 +20,7 @@ var (
 func Decoder(target interface{}, allowUnused bool) (*mapstructure.Decoder, error) {
 	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
 		ErrorUnused: !allowUnused,
-		DecodeHook:  mapstructure.ComposeDecodeHookFunc(MapStructureDecodeHookFunc(), mapstructure.TextUnmarshallerHookFunc()),
+		DecodeHook:  mapstructure.ComposeDecodeHookFunc(MapStructureDecodeHookFunc(), mapstructure.StringToTimeDurationHookFunc(), mapstructure.TextUnmarshallerHookFunc()),
 		Result:      target,
 	})
 	if err != nil {
@@ -38,6 +38,9 @@ func LoadAndSanitizeConfig(configData []byte) (string, error) {
 		return "", errors.Wrap(err, "LoadAndSanitizeConfig: failed")
 	}
 
+	sanitizeProxychains(configMap)
+	sanitizeSites(configMap)
+
 	sanitized, err := yaml.Marshal(configMap)
 	if err != nil {
 		return "", errors.Wrap(err, "LoadAndSanitizeConfig: YAML reserialization failed")
@@ -131,9 +134,58 @@ func Load(configData []byte) (*Config, error) {
 	if err := decoder.Decode(configMap); err != nil {
 		return nil, errors.Wrap(err, "Load: second-pass config map decoding failed")
 	}
+
+	if err := cfg.resolveCredentials(); err != nil {
+		return nil, errors.Wrap(err, "Load: resolving credentials failed")
+	}
+	if err := cfg.Admin.resolveToken(); err != nil {
+		return nil, errors.Wrap(err, "Load: resolving admin API token failed")
+	}
+	if err := cfg.validateAdmin(); err != nil {
+		return nil, errors.Wrap(err, "Load: admin API configuration is invalid")
+	}
+	if err := cfg.validateListenerTimeouts(); err != nil {
+		return nil, errors.Wrap(err, "Load: listener timeouts are invalid")
+	}
+	if err := cfg.validateSites(); err != nil {
+		return nil, errors.Wrap(err, "Load: site configuration is invalid")
+	}
+	cfg.inheritTimeouts()
+	if err := cfg.validateMetrics(); err != nil {
+		return nil, errors.Wrap(err, "Load: metrics configuration is invalid")
+	}
 	return cfg, nil
 }
 
+// LoadSite loads a single site definition, such as one submitted to the admin
+// API. Default timeouts are inherited from cfg.
+func LoadSite(siteData []byte, cfg *Config) (SiteConfig, error) {
+	siteMap, err := loadConfigMap(siteData)
+	if err != nil {
+		return SiteConfig{}, errors.Wrap(err, "LoadSite: failed")
+	}
+
+	site := SiteConfig{}
+	decoder, err := Decoder(&site, false)
+	if err != nil {
+		return SiteConfig{}, errors.Wrapf(err, "LoadSite: site decoder failed to initialize")
+	}
+
+	if err := decoder.Decode(siteMap); err != nil {
+		return SiteConfig{}, errors.Wrap(err, "LoadSite: site decoding failed")
+	}
+
+	if err := site.Backend.validateTargets(); err != nil {
+		return SiteConfig{}, errors.Wrap(err, "LoadSite: backend configuration is invalid")
+	}
+	if err := cfg.Metrics.validateSiteMetricsLabels(site); err != nil {
+		return SiteConfig{}, errors.Wrap(err, "LoadSite: metrics labels are invalid")
+	}
+
+	site.Backend.Timeouts.inherit(cfg.Timeouts.Backend)
+	return site, nil
+}
+
 // MapStructureDecoder is detected by MapStructureDecodeHookFunc to allow a type
 // to decode itself.
 type MapStructureDecoder interface {
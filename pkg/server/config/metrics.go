@@ -0,0 +1,69 @@
+package config
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MetricsConfig configures the Prometheus metrics endpoint. Metrics are always
+// served on the admin API, and also on their own listener if an address is set.
+type MetricsConfig struct {
+	ListenAddr HostSpec `mapstructure:"listen_addr,omitempty"` // ListenAddr is the TCP address to serve metrics on
+	Path       string   `mapstructure:"path,omitempty"`        // Path is the HTTP path of the metrics (default /metrics)
+	// Labels are extra labels added to every metric, with their default values.
+	// Sites can override the values with their own metrics_labels.
+	Labels map[string]string `mapstructure:"labels,omitempty"`
+}
+
+// ReservedMetricsLabels are the labels used by the built-in metrics, which can't
+// be used as extra labels.
+//
+//nolint:gochecknoglobals
+var ReservedMetricsLabels = []string{
+	"listener", "site", "target", "code", "outcome", "proxychain", "hop", "breaker",
+}
+
+//nolint:gochecknoglobals
+var metricsLabelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateMetricsLabels checks every extra label has a valid name and a default
+// value, so that all series of a metric have the same labels.
+func (m MetricsConfig) validateMetricsLabels() error {
+	for name, value := range m.Labels {
+		if !metricsLabelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") ||
+			slices.Contains(ReservedMetricsLabels, name) {
+			return errors.Errorf("invalid extra metrics label name: %q", name)
+		}
+		if value == "" {
+			return errors.Wrapf(ErrInconsistentLabels, "%v", name)
+		}
+	}
+	return nil
+}
+
+// validateSiteMetricsLabels checks site only overrides extra labels which have
+// defaults set.
+func (m MetricsConfig) validateSiteMetricsLabels(site SiteConfig) error {
+	for name := range site.MetricsLabels {
+		if _, found := m.Labels[name]; !found {
+			return errors.Wrapf(ErrInconsistentLabels, "site %v: %v", site.Host, name)
+		}
+	}
+	return nil
+}
+
+// validateMetrics checks the extra metrics labels of the config.
+func (c *Config) validateMetrics() error {
+	if err := c.Metrics.validateMetricsLabels(); err != nil {
+		return err
+	}
+	for _, site := range c.Sites {
+		if err := c.Metrics.validateSiteMetricsLabels(site); err != nil {
+			return err
+		}
+	}
+	return nil
+}
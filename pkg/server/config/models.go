@@ -3,9 +3,11 @@ package config
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,7 +15,18 @@ import (
 type ListenerType string
 
 const (
-	SiteConfigTypeHTTPEdge ListenerType = "http-edge"
+	SiteConfigTypeHTTPEdge       ListenerType = "http-edge"
+	SiteConfigTypeHTTPSEdge      ListenerType = "https-edge"
+	SiteConfigTypeTLSPassthrough ListenerType = "tls-passthrough"
+	SiteConfigTypeTCPForward     ListenerType = "tcp-forward"
+)
+
+type HostHeaderMode string
+
+const (
+	HostHeaderTarget   HostHeaderMode = "target"
+	HostHeaderPreserve HostHeaderMode = "preserve"
+	HostHeaderFixed    HostHeaderMode = "fixed"
 )
 
 type TargetSelectType string
@@ -21,13 +34,19 @@ type TargetSelectType string
 const (
 	TargetSelectTypeDefault   TargetSelectType = ""
 	TargetSelectTypePathIndex TargetSelectType = "path"
+	TargetSelectTypeBalance   TargetSelectType = "balance"
 )
 
+var ErrTargetsRequireBalance = errors.New("targets are only used by the balance target selector")
+
 type Config struct {
-	Global      GlobalConfig              `mapstructure:"global,omitempty"`
-	Proxychains map[string][]Proxy        `mapstructure:"proxychains,omitempty"`
-	Listeners   map[string]ListenerConfig `mapstructure:"listeners,omitempty"`
-	Sites       []SiteConfig              `mapstructure:"sites,omitempty"`
+	Global      GlobalConfig                `mapstructure:"global,omitempty"`
+	Proxychains map[string]ProxychainConfig `mapstructure:"proxychains,omitempty"`
+	Listeners   map[string]ListenerConfig   `mapstructure:"listeners,omitempty"`
+	Sites       []SiteConfig                `mapstructure:"sites,omitempty"`
+	Timeouts    Timeouts                    `mapstructure:"timeouts,omitempty"`
+	Admin       AdminConfig                 `mapstructure:"admin,omitempty"`
+	Metrics     MetricsConfig               `mapstructure:"metrics,omitempty"`
 }
 
 type GlobalConfig struct {
@@ -41,8 +60,9 @@ type LoggingConfig struct {
 }
 
 type ListenerConfig struct {
-	ListenAddr   HostSpec     `mapstructure:"listen_addr"` // ListenAddr is the hostname and port number
-	ListenerType ListenerType `mapstructure:"listen_type"` // ListenerType is the type of listener to attach
+	ListenAddr   HostSpec         `mapstructure:"listen_addr"`        // ListenAddr is the hostname and port number
+	ListenerType ListenerType     `mapstructure:"listen_type"`        // ListenerType is the type of listener to attach
+	Timeouts     ListenerTimeouts `mapstructure:"timeouts,omitempty"` // Timeouts override the default listener timeouts
 }
 
 type SiteConfig struct {
@@ -51,14 +71,70 @@ type SiteConfig struct {
 	Backend    BackendConfig `mapstructure:"backend"`    // Backend is the backend for the server
 	Proxychain string        `mapstructure:"proxychain"` // Proxychain is the proxychain to use for connections
 	Method     string        `mapstructure:"method"`     // Method is the type of proxy to use. Options are "http-edge"
+	// Certificate is the TLS certificate and key presented by TLS terminating listeners for this site.
+	Certificate *TLSKeyPair `mapstructure:"certificate,omitempty"`
+	// MetricsLabels override the values of the extra metrics labels for this site.
+	MetricsLabels map[string]string `mapstructure:"metrics_labels,omitempty"`
 }
 
 type BackendConfig struct {
 	Target             HostSpec                      `mapstructure:"target"`
+	Targets            []WeightedTarget              `mapstructure:"targets,omitempty"`              // Targets are the targets used by the balance selector
 	TLS                TLS                           `mapstructure:"tls,omitempty"`                  // TLS configures TLS connectivity to the backend
 	TargetSelect       TargetSelectType              `mapstructure:"target_select,omitempty"`        // TargetSelect specifies how a dynamic target should be selected
 	TargetSelectParams map[string]interface{}        `mapstructure:"target_select_params,omitempty"` // TargetSelectParams is the key-value parameters for the given target selector
 	HTTPHeaders        `mapstructure:"http_headers"` // HTTPHeaders configures modifications to the HTTP headers
+	// HostHeader configures the Host header sent to the backend. Host in set_headers takes precedence.
+	HostHeader HostHeader `mapstructure:"host_header,omitempty"`
+	// HealthCheck configures active and passive health checking of the backend targets.
+	HealthCheck HealthCheck `mapstructure:"health_check,omitempty"`
+	// Retry configures retrying of failed backend requests.
+	Retry RetryPolicy `mapstructure:"retry,omitempty"`
+	// CircuitBreaker configures circuit breaking of failing backend targets.
+	CircuitBreaker CircuitBreaker `mapstructure:"circuit_breaker,omitempty"`
+	// ResponseRewrite configures rewriting of backend origins in responses back to the public site.
+	ResponseRewrite ResponseRewrite `mapstructure:"response_rewrite,omitempty"`
+	// ForwardedHeaders configures the headers which describe the original client to the backend.
+	ForwardedHeaders ForwardedHeaders `mapstructure:"forwarded_headers,omitempty"`
+	// FlushInterval is the maximum time response data is buffered before being flushed to the client. Zero only
+	// flushes at the end of the response and a negative value flushes after every write. Event streams and
+	// responses of unknown length are always flushed immediately.
+	FlushInterval time.Duration `mapstructure:"flush_interval,omitempty"`
+	// ConnectionPool configures the cache of backend connections.
+	ConnectionPool ConnectionPool `mapstructure:"connection_pool,omitempty"`
+	// Timeouts override the default backend timeouts.
+	Timeouts BackendTimeouts `mapstructure:"timeouts,omitempty"`
+}
+
+// validateTargets rejects a list of targets for selectors which would ignore it.
+func (b BackendConfig) validateTargets() error {
+	if len(b.Targets) > 0 && b.TargetSelect != TargetSelectTypeBalance {
+		return errors.Wrapf(ErrTargetsRequireBalance, "target_select: %q", b.TargetSelect)
+	}
+	return nil
+}
+
+// validateSites checks the backend configuration of every site.
+func (c *Config) validateSites() error {
+	for _, site := range c.Sites {
+		if err := site.Backend.validateTargets(); err != nil {
+			return errors.Wrapf(err, "site %v", site.Host)
+		}
+	}
+	return nil
+}
+
+// ConnectionPool configures reuse of backend connections. A transport is kept for
+// each distinct backend address and TLS server name.
+type ConnectionPool struct {
+	MaxTransports int           `mapstructure:"max_transports,omitempty"` // MaxTransports is the maximum number of cached transports
+	IdleTimeout   time.Duration `mapstructure:"idle_timeout,omitempty"`   // IdleTimeout is how long unused transports and connections are kept
+}
+
+// WeightedTarget is a backend target with a relative load balancing weight.
+type WeightedTarget struct {
+	Target HostSpec `mapstructure:"target"`           // Target is the hostname and port of the target
+	Weight uint     `mapstructure:"weight,omitempty"` // Weight is the relative share of requests (default 1)
 }
 
 type TLS struct {
@@ -78,8 +154,99 @@ type HTTPHeaders struct {
 	DelHeaders []string `mapstructure:"del_headers,omitempty"`
 }
 
+// HealthCheck configures health checking of backend targets. Unhealthy targets
+// are skipped by the balance target selector.
+type HealthCheck struct {
+	Active  ActiveHealthCheck  `mapstructure:"active,omitempty"`  // Active configures periodic health check requests
+	Passive PassiveHealthCheck `mapstructure:"passive,omitempty"` // Passive configures ejection based on request failures
+}
+
+// ActiveHealthCheck configures periodic HTTP health checks, which are made via
+// the site proxychain.
+type ActiveHealthCheck struct {
+	Enable             bool          `mapstructure:"enable"`                        // Enable turns on active health checks
+	Path               string        `mapstructure:"path,omitempty"`                // Path is the request path (default /)
+	ExpectedStatus     []int         `mapstructure:"expected_status,omitempty"`     // ExpectedStatus are healthy status codes (default 2xx and 3xx)
+	Interval           time.Duration `mapstructure:"interval,omitempty"`            // Interval is the time between checks (default 10s)
+	Timeout            time.Duration `mapstructure:"timeout,omitempty"`             // Timeout is the timeout for each check (default 5s)
+	HealthyThreshold   uint          `mapstructure:"healthy_threshold,omitempty"`   // HealthyThreshold is the successes needed to reinstate a target (default 2)
+	UnhealthyThreshold uint          `mapstructure:"unhealthy_threshold,omitempty"` // UnhealthyThreshold is the failures needed to mark a target unhealthy (default 3)
+}
+
+// PassiveHealthCheck configures ejection of targets after consecutive failed
+// requests. Connection errors are always failures.
+type PassiveHealthCheck struct {
+	MaxFailures   uint          `mapstructure:"max_failures,omitempty"`   // MaxFailures is the consecutive failures before ejection (0 disables)
+	EjectDuration time.Duration `mapstructure:"eject_duration,omitempty"` // EjectDuration is how long a target is ejected (default 30s)
+	FailureStatus []int         `mapstructure:"failure_status,omitempty"` // FailureStatus are response codes which also count as failures
+}
+
+// RetryPolicy configures retrying of failed backend requests. Requests are only
+// retried if the method is idempotent (or NonIdempotent is set) and the body is
+// empty or small enough to be buffered. With multiple targets, retries prefer
+// targets which have not yet been tried.
+type RetryPolicy struct {
+	MaxAttempts   uint          `mapstructure:"max_attempts,omitempty"`    // MaxAttempts is the total attempts including the first (0 or 1 disables retries)
+	Backoff       time.Duration `mapstructure:"backoff,omitempty"`         // Backoff is the initial delay, doubled after each attempt (default 100ms)
+	MaxBackoff    time.Duration `mapstructure:"max_backoff,omitempty"`     // MaxBackoff is the maximum delay between attempts (default 2s)
+	OnError       bool          `mapstructure:"on_error,omitempty"`        // OnError retries when the backend could not be contacted
+	OnStatus      []int         `mapstructure:"on_status,omitempty"`       // OnStatus are the response codes which are retried
+	NonIdempotent bool          `mapstructure:"non_idempotent,omitempty"`  // NonIdempotent allows retrying non-idempotent methods such as POST
+	MaxBodyBuffer int64         `mapstructure:"max_body_buffer,omitempty"` // MaxBodyBuffer is the largest body buffered for replay (default 64KiB)
+}
+
+// CircuitBreaker configures a circuit breaker which fails requests fast while a
+// destination is failing. A zero FailureThreshold disables the breaker.
+type CircuitBreaker struct {
+	FailureThreshold uint          `mapstructure:"failure_threshold,omitempty"`  // FailureThreshold is the consecutive failures which open the circuit
+	OpenDuration     time.Duration `mapstructure:"open_duration,omitempty"`      // OpenDuration is how long the circuit stays open (default 30s)
+	HalfOpenRequests uint          `mapstructure:"half_open_requests,omitempty"` // HalfOpenRequests are the trial requests which must succeed to close the circuit (default 1)
+	FailureStatus    []int         `mapstructure:"failure_status,omitempty"`     // FailureStatus are response codes counted as failures (backends only)
+}
+
+// ResponseRewrite configures which response headers are mapped from the backend
+// origin back to the public scheme, host and path.
+type ResponseRewrite struct {
+	Location     bool `mapstructure:"location,omitempty"`      // Location rewrites Location, Content-Location and Refresh
+	CookieDomain bool `mapstructure:"cookie_domain,omitempty"` // CookieDomain rewrites Set-Cookie Domain attributes
+	CookiePath   bool `mapstructure:"cookie_path,omitempty"`   // CookiePath rewrites Set-Cookie Path attributes
+}
+
+// HostHeader configures how the backend Host header is chosen.
+type HostHeader struct {
+	// Mode is one of "target" (the default) to use the backend target address, "preserve" to send the Host the
+	// client sent, or "fixed" to always send Value.
+	Mode  HostHeaderMode `mapstructure:"mode,omitempty"`
+	Value string         `mapstructure:"value,omitempty"` // Value is the Host header used by the fixed mode
+}
+
+// ForwardedHeaders configures the client information headers added to outbound
+// requests. If any header is enabled, incoming forwarding headers are stripped
+// unless the client address is in TrustedProxies.
+type ForwardedHeaders struct {
+	XForwardedFor   bool           `mapstructure:"x_forwarded_for,omitempty"`   // XForwardedFor appends the client address to X-Forwarded-For
+	XForwardedProto bool           `mapstructure:"x_forwarded_proto,omitempty"` // XForwardedProto sets X-Forwarded-Proto to the client protocol
+	XForwardedHost  bool           `mapstructure:"x_forwarded_host,omitempty"`  // XForwardedHost sets X-Forwarded-Host to the client Host header
+	Forwarded       bool           `mapstructure:"forwarded,omitempty"`         // Forwarded appends an RFC 7239 Forwarded element
+	TrustedProxies  []netip.Prefix `mapstructure:"trusted_proxies,omitempty"`   // TrustedProxies are the CIDRs whose forwarding headers are kept
+}
+
 type Proxy struct {
 	Proxy ProxyURL `mapstructure:"proxy"`
+	// Credentials configures where the credentials for the proxy are read from.
+	Credentials ProxyCredentials `mapstructure:"credentials,omitempty"`
+	// Auth configures how the proxy is authenticated to.
+	Auth ProxyAuth `mapstructure:"auth,omitempty"`
+	// TLS configures the connection to https proxies.
+	TLS ProxyTLS `mapstructure:"tls,omitempty"`
+	// PAC configures the proxy auto-config file for pac hops.
+	PAC PACConfig `mapstructure:"pac,omitempty"`
+	// SSH configures the session to ssh hops.
+	SSH SSHConfig `mapstructure:"ssh,omitempty"`
+	// CircuitBreaker configures circuit breaking of connections to this proxy.
+	CircuitBreaker CircuitBreaker `mapstructure:"circuit_breaker,omitempty"`
+	// Timeouts override the default proxy hop timeouts.
+	Timeouts ProxyTimeouts `mapstructure:"timeouts,omitempty"`
 }
 
 type HostSpec struct {
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"net/netip"
 	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -9,8 +11,138 @@ import (
 const (
 	ProxyEnvironment ProxyURL = "environment"
 	ProxyDirect      ProxyURL = "direct"
+	ProxyPAC         ProxyURL = "pac"
 )
 
+type FailoverMode string
+
+const (
+	FailoverOrdered FailoverMode = "ordered"
+	FailoverRace    FailoverMode = "race"
+)
+
+// ProxychainConfig is a proxychain made of one or more alternative chains of
+// proxies. It is configured either as a plain list of proxies, or as a map
+// listing alternatives which are failed over between.
+type ProxychainConfig struct {
+	Failover     FailoverMode     `mapstructure:"failover,omitempty"`     // Failover is how alternatives are tried (default ordered)
+	RaceDelay    time.Duration    `mapstructure:"race_delay,omitempty"`   // RaceDelay is the delay before racing the next alternative (default 250ms)
+	Alternatives [][]Proxy        `mapstructure:"alternatives,omitempty"` // Alternatives are the chains of proxies which can be used
+	Rules        []ProxychainRule `mapstructure:"rules,omitempty"`        // Rules route matching destinations through other hops
+	DNS          ProxychainDNS    `mapstructure:"dns,omitempty"`          // DNS configures where destination hostnames are resolved
+}
+
+// ProxychainRule routes destinations matching all of its criteria through its
+// own hops instead of the proxychain alternatives. Rules are evaluated in order
+// and the first match is used.
+type ProxychainRule struct {
+	Hosts    []string       `mapstructure:"hosts,omitempty"`    // Hosts are glob patterns matched against the destination host
+	Networks []netip.Prefix `mapstructure:"networks,omitempty"` // Networks are CIDRs matched against IP address destinations
+	Ports    []uint16       `mapstructure:"ports,omitempty"`    // Ports are matched against the destination port
+	Via      []Proxy        `mapstructure:"via,omitempty"`      // Via are the hops used for matching destinations (default direct)
+}
+
+type DNSResolution string
+
+const (
+	DNSRemote            DNSResolution = "remote"
+	DNSLocal             DNSResolution = "local"
+	DNSLocalWithFallback DNSResolution = "local-with-fallback"
+)
+
+// ProxychainDNS configures how destination hostnames of a proxychain are
+// resolved. Remote resolution passes hostnames to the last hop of the chain.
+type ProxychainDNS struct {
+	Resolution        DNSResolution         `mapstructure:"resolution,omitempty"`         // Resolution is where hostnames are resolved (default remote)
+	Hosts             map[string]netip.Addr `mapstructure:"hosts,omitempty"`              // Hosts are static addresses which override resolution
+	Servers           []string              `mapstructure:"servers,omitempty"`            // Servers are the DNS servers for local resolution (default system)
+	ThroughProxychain bool                  `mapstructure:"through_proxychain,omitempty"` // ThroughProxychain sends DNS queries over TCP through the proxychain
+	Timeout           time.Duration         `mapstructure:"timeout,omitempty"`            // Timeout is the timeout of local lookups (default 5s)
+}
+
+// MapStructureDecode implements unmarshalling for ProxychainConfig.
+func (p *ProxychainConfig) MapStructureDecode(input interface{}) error {
+	switch input.(type) {
+	case nil:
+		p.Alternatives = [][]Proxy{nil}
+	case []interface{}:
+		var hops []Proxy
+		decoder, err := Decoder(&hops, false)
+		if err != nil {
+			return err
+		}
+		if err := decoder.Decode(input); err != nil {
+			return errors.Wrap(err, "ProxychainConfig.MapStructureDecode")
+		}
+		p.Alternatives = [][]Proxy{hops}
+	case map[string]interface{}:
+		// Decode via a type without this method to avoid recursing.
+		type proxychainConfig ProxychainConfig
+		decoded := proxychainConfig{}
+		decoder, err := Decoder(&decoded, false)
+		if err != nil {
+			return err
+		}
+		if err := decoder.Decode(input); err != nil {
+			return errors.Wrap(err, "ProxychainConfig.MapStructureDecode")
+		}
+		*p = ProxychainConfig(decoded)
+	default:
+		return errors.Wrapf(ErrInvalidInputType, "expected list or map got %T", input)
+	}
+	return nil
+}
+
+type ProxyAuthMethod string
+
+const (
+	ProxyAuthBasic     ProxyAuthMethod = "basic"
+	ProxyAuthNTLM      ProxyAuthMethod = "ntlm"
+	ProxyAuthNegotiate ProxyAuthMethod = "negotiate"
+)
+
+// ProxyAuth configures how a hop authenticates to an HTTP proxy. The username
+// and password are taken from the proxy credentials. If no method is set then
+// basic authentication is used when credentials are available.
+type ProxyAuth struct {
+	Method      ProxyAuthMethod `mapstructure:"method,omitempty"`      // Method is the authentication scheme to use
+	Domain      string          `mapstructure:"domain,omitempty"`      // Domain is the NTLM domain (or use a DOMAIN\user username)
+	Workstation string          `mapstructure:"workstation,omitempty"` // Workstation is the NTLM workstation name
+	Kerberos    KerberosAuth    `mapstructure:"kerberos,omitempty"`    // Kerberos configures SPNEGO with a keytab for negotiate
+}
+
+// KerberosAuth configures Kerberos authentication from a keytab.
+type KerberosAuth struct {
+	Keytab string `mapstructure:"keytab,omitempty"` // Keytab is the keytab file for the username (enables Kerberos)
+	Config string `mapstructure:"config,omitempty"` // Config is the krb5.conf file (default /etc/krb5.conf)
+	Realm  string `mapstructure:"realm,omitempty"`  // Realm is the Kerberos realm (default from krb5.conf)
+	SPN    string `mapstructure:"spn,omitempty"`    // SPN is the proxy service principal (default HTTP/<proxy host>)
+}
+
+// ProxyTLS configures the TLS connection to an https proxy.
+type ProxyTLS struct {
+	NoVerify             bool               `mapstructure:"no_verify,omitempty"`          // NoVerify means do not verify the proxy certificate
+	ServerNameIndication *string            `mapstructure:"sni_name,omitempty"`           // ServerNameIndication is the SNI name to send (default proxy host)
+	CACerts              TLSCertificatePool `mapstructure:"ca_certs,omitempty"`           // CACerts are the CAs to verify the proxy with (default system)
+	ClientCertificate    *TLSKeyPair        `mapstructure:"client_certificate,omitempty"` // ClientCertificate is presented to the proxy if it is set
+}
+
+// PACConfig configures a proxy auto-config file hop.
+type PACConfig struct {
+	Source   string        `mapstructure:"source,omitempty"`    // Source is the PAC file path or an http(s) URL fetched directly
+	CacheTTL time.Duration `mapstructure:"cache_ttl,omitempty"` // CacheTTL is how long results are cached per destination (default 5m)
+}
+
+// SSHConfig configures an ssh hop. Connections are opened as direct-tcpip
+// channels over a single SSH session to the host.
+type SSHConfig struct {
+	IdentityFiles     []string      `mapstructure:"identity_files,omitempty"`     // IdentityFiles are private keys to authenticate with (default ~/.ssh/id_*)
+	Agent             *bool         `mapstructure:"agent,omitempty"`              // Agent enables the SSH agent at SSH_AUTH_SOCK (default true if set)
+	KnownHosts        []string      `mapstructure:"known_hosts,omitempty"`        // KnownHosts are the known_hosts files to verify the host key with (default ~/.ssh/known_hosts)
+	NoVerify          bool          `mapstructure:"no_verify,omitempty"`          // NoVerify disables host key verification
+	KeepaliveInterval time.Duration `mapstructure:"keepalive_interval,omitempty"` // KeepaliveInterval is how often the session is checked (default 30s)
+}
+
 // ProxyURL is a custom type to validate roxy specifications.
 type ProxyURL string
 
@@ -22,7 +154,7 @@ func (p *ProxyURL) UnmarshalText(text []byte) error {
 		return errors.Wrapf(err, "ProxyURL UnmarshalText")
 	}
 	switch s {
-	case (string)(ProxyDirect), (string)(ProxyEnvironment):
+	case (string)(ProxyDirect), (string)(ProxyEnvironment), (string)(ProxyPAC):
 		*p = ProxyURL(s)
 		return nil
 	default:
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnsupportedListenerTimeout = errors.New("timeout is not supported by the listener type")
+)
+
+// Timeouts are the default timeouts of proxychain hops, backends and listeners.
+// A timeout which is not set on a hop, backend or listener uses the default
+// here. Zero or negative timeouts are disabled.
+type Timeouts struct {
+	Proxy    ProxyTimeouts    `mapstructure:"proxy,omitempty"`    // Proxy are the default timeouts of proxychain hops
+	Backend  BackendTimeouts  `mapstructure:"backend,omitempty"`  // Backend are the default timeouts of backends
+	Listener ListenerTimeouts `mapstructure:"listener,omitempty"` // Listener are the default timeouts of listeners
+}
+
+// ProxyTimeouts configures the timeouts of a proxychain hop.
+type ProxyTimeouts struct {
+	// Connect is the time allowed to open a connection through the hop, including
+	// reaching the proxy through the previous hops and the proxy handshake.
+	Connect time.Duration `mapstructure:"connect,omitempty"`
+}
+
+// BackendTimeouts configures the timeouts of requests to a backend.
+type BackendTimeouts struct {
+	Connect        time.Duration `mapstructure:"connect,omitempty"`         // Connect is the time allowed to connect to the backend through the proxychain
+	TLSHandshake   time.Duration `mapstructure:"tls_handshake,omitempty"`   // TLSHandshake is the time allowed for the backend TLS handshake
+	ResponseHeader time.Duration `mapstructure:"response_header,omitempty"` // ResponseHeader is the time allowed for the backend to send response headers
+	Request        time.Duration `mapstructure:"request,omitempty"`         // Request is the time allowed for the whole request, excluding upgraded connections
+}
+
+// ListenerTimeouts configures the timeouts of client connections to a listener.
+type ListenerTimeouts struct {
+	ReadHeader time.Duration `mapstructure:"read_header,omitempty"` // ReadHeader is the time allowed to read request headers (or the TLS ClientHello)
+	Read       time.Duration `mapstructure:"read,omitempty"`        // Read is the time allowed to read a whole request
+	Write      time.Duration `mapstructure:"write,omitempty"`       // Write is the time allowed to write a response
+	// Idle is how long idle keep-alive connections are kept open. On tls-passthrough and tcp-forward listeners it
+	// is how long a connection may pass no data in either direction before it is closed, and is only applied if
+	// set on the listener.
+	Idle time.Duration `mapstructure:"idle,omitempty"`
+}
+
+// inheritTimeout sets value to the default if it is not set.
+func inheritTimeout(value *time.Duration, defaultValue time.Duration) {
+	if *value == 0 {
+		*value = defaultValue
+	}
+}
+
+func (t *ProxyTimeouts) inherit(defaults ProxyTimeouts) {
+	inheritTimeout(&t.Connect, defaults.Connect)
+}
+
+func (t *BackendTimeouts) inherit(defaults BackendTimeouts) {
+	inheritTimeout(&t.Connect, defaults.Connect)
+	inheritTimeout(&t.TLSHandshake, defaults.TLSHandshake)
+	inheritTimeout(&t.ResponseHeader, defaults.ResponseHeader)
+	inheritTimeout(&t.Request, defaults.Request)
+}
+
+func (t *ListenerTimeouts) inherit(defaults ListenerTimeouts) {
+	inheritTimeout(&t.ReadHeader, defaults.ReadHeader)
+	inheritTimeout(&t.Read, defaults.Read)
+	inheritTimeout(&t.Write, defaults.Write)
+	inheritTimeout(&t.Idle, defaults.Idle)
+}
+
+// inheritTimeouts applies the default timeouts to every proxychain hop, backend
+// and listener in the config.
+func (c *Config) inheritTimeouts() {
+	for _, proxychain := range c.Proxychains {
+		for _, alternative := range proxychain.Alternatives {
+			for idx := range alternative {
+				alternative[idx].Timeouts.inherit(c.Timeouts.Proxy)
+			}
+		}
+		for _, rule := range proxychain.Rules {
+			for idx := range rule.Via {
+				rule.Via[idx].Timeouts.inherit(c.Timeouts.Proxy)
+			}
+		}
+	}
+	for idx := range c.Sites {
+		c.Sites[idx].Backend.Timeouts.inherit(c.Timeouts.Backend)
+	}
+	for name, listener := range c.Listeners {
+		defaults := c.Timeouts.Listener
+		switch listener.ListenerType {
+		case SiteConfigTypeTLSPassthrough, SiteConfigTypeTCPForward:
+			// Spliced sessions may be quiet for long periods, so the keep-alive
+			// idle default doesn't apply.
+			defaults.Idle = 0
+		default:
+		}
+		listener.Timeouts.inherit(defaults)
+		c.Listeners[name] = listener
+	}
+}
+
+// validateListenerTimeouts rejects timeouts set on listeners whose type does not
+// use them. Stream listeners only use idle, and tls-passthrough listeners also
+// use read_header for the ClientHello. It must be called before the defaults are
+// inherited.
+func (c *Config) validateListenerTimeouts() error {
+	for name, listener := range c.Listeners {
+		unsupported := []string{}
+		switch listener.ListenerType {
+		case SiteConfigTypeTLSPassthrough, SiteConfigTypeTCPForward:
+			if listener.Timeouts.Read != 0 {
+				unsupported = append(unsupported, "read")
+			}
+			if listener.Timeouts.Write != 0 {
+				unsupported = append(unsupported, "write")
+			}
+			if listener.ListenerType == SiteConfigTypeTCPForward && listener.Timeouts.ReadHeader != 0 {
+				unsupported = append(unsupported, "read_header")
+			}
+		default:
+		}
+		if len(unsupported) > 0 {
+			return errors.Wrapf(ErrUnsupportedListenerTimeout, "listener %v (%v): %v", name, listener.ListenerType,
+				strings.Join(unsupported, ", "))
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
 	"os"
@@ -20,8 +21,27 @@ const (
 var (
 	ErrInvalidInputType = errors.New("invalid input type for decoder")
 	ErrInvalidPEMFile   = errors.New("PEM file could not be added to certificate pool")
+	ErrInvalidKeyPair   = errors.New("certificate and key could not be loaded as a key pair")
 )
 
+// loadPemEntry resolves a config entry which is either a path to a PEM file or
+// inline PEM data. It also returns a short sample of the entry for use in errors.
+func loadPemEntry(entry string) ([]byte, string, error) {
+	if _, err := os.Stat(entry); err == nil {
+		// Is a file
+		pem, err := ioutil.ReadFile(entry)
+		if err != nil {
+			return nil, entry, errors.Wrapf(err, "could not read PEM file: %s", entry)
+		}
+		return pem, entry, nil
+	}
+
+	if len(entry) < TLSCertificatePoolMaxNonFileEntryReturn {
+		return []byte(entry), entry, nil
+	}
+	return []byte(entry), entry[:TLSCertificatePoolMaxNonFileEntryReturn], nil
+}
+
 // TLSCertificateMap encodes a list of certificates and stores them in a hashmap
 // for easy lookups. It is similar to the standard library CertPool.
 type Sum224 [sha256.Size224]byte
@@ -113,22 +133,9 @@ func (t *TLSCertificateMap) MapStructureDecode(input interface{}) error {
 	})
 
 	for idx, entry := range caCertSpecEntries {
-		var pem []byte
-		itemSample := ""
-		if _, err := os.Stat(entry); err == nil {
-			// Is a file
-			pem, err = ioutil.ReadFile(entry)
-			if err != nil {
-				return errors.Wrapf(err, "could not read certificate file: %s", entry)
-			}
-			itemSample = entry
-		} else {
-			pem = []byte(entry)
-			if len(entry) < TLSCertificatePoolMaxNonFileEntryReturn {
-				itemSample = entry
-			} else {
-				itemSample = entry[:TLSCertificatePoolMaxNonFileEntryReturn]
-			}
+		pem, itemSample, err := loadPemEntry(entry)
+		if err != nil {
+			return err
 		}
 
 		certificates, err := certutils.LoadCertificatesFromPem(pem)
@@ -210,27 +217,14 @@ func (t *TLSCertificatePool) MapStructureDecode(input interface{}) error {
 		t.CertPool = x509.NewCertPool()
 	}
 
-	//nolint:nestif
 	for idx, entry := range caCertSpecEntries {
-		var pem []byte
-		itemSample := ""
 		if entry == TLSCACertsSystem {
 			// skip - handled above
 			continue
-		} else if _, err := os.Stat(entry); err == nil {
-			// Is a file
-			pem, err = ioutil.ReadFile(entry)
-			if err != nil {
-				return errors.Wrapf(err, "could not read certificate file: %s", entry)
-			}
-			itemSample = entry
-		} else {
-			pem = []byte(entry)
-			if len(entry) < TLSCertificatePoolMaxNonFileEntryReturn {
-				itemSample = entry
-			} else {
-				itemSample = entry[:TLSCertificatePoolMaxNonFileEntryReturn]
-			}
+		}
+		pem, itemSample, err := loadPemEntry(entry)
+		if err != nil {
+			return err
 		}
 		if ok := t.CertPool.AppendCertsFromPEM(pem); !ok {
 			return errors.Wrapf(ErrInvalidPEMFile, "failed at item %v: %v", idx, itemSample)
@@ -241,3 +235,52 @@ func (t *TLSCertificatePool) MapStructureDecode(input interface{}) error {
 
 	return nil
 }
+
+// TLSKeyPair is our custom type for decoding a certificate and private key out
+// of YAML. The cert and key fields may each be either a filename or inline PEM.
+type TLSKeyPair struct {
+	*tls.Certificate
+	original map[string]string
+}
+
+// MapStructureDecode implements the yaml.Unmarshaler interface for TLS key pairs.
+func (t *TLSKeyPair) MapStructureDecode(input interface{}) error {
+	inputMap, ok := input.(map[string]interface{})
+	if !ok {
+		return errors.Wrapf(ErrInvalidInputType, "expected map with cert and key got %T", input)
+	}
+
+	original := map[string]string{}
+	for k, v := range inputMap {
+		strValue, ok := v.(string)
+		if !ok {
+			return errors.Wrapf(ErrInvalidInputType, "TLSKeyPair.MapStructureDecode: %s must be a string", k)
+		}
+		switch k {
+		case "cert", "key":
+			original[k] = strValue
+		default:
+			return errors.Wrapf(ErrInvalidInputType, "TLSKeyPair.MapStructureDecode: unknown key %s", k)
+		}
+	}
+
+	certPem, certSample, err := loadPemEntry(original["cert"])
+	if err != nil {
+		return err
+	}
+
+	// Note: the key sample is deliberately never included in errors.
+	keyPem, _, err := loadPemEntry(original["key"])
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidKeyPair, "cert %v: %v", certSample, err)
+	}
+
+	t.Certificate = &cert
+	t.original = original
+	return nil
+}
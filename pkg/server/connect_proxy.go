@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultHTTPProxyPort  = "8080"
+	defaultHTTPSProxyPort = "443"
+	// maxProxyAuthRounds is the initial request plus the answer to one
+	// challenge. A 407 response to the answer means the credentials were
+	// rejected.
+	maxProxyAuthRounds = 2
+)
+
+var (
+	ErrProxyAuthRequired  = errors.New("proxy requires authentication")
+	ErrProxyConnectFailed = errors.New("proxy refused CONNECT request")
+)
+
+// httpConnectDialer dials addresses through an HTTP proxy using the CONNECT
+// method. The proxy is reached with the forward dialer.
+//
+// It replaces go.connect-proxy-scheme, which has no way to set credentials on
+// the dialers it registers, and which drops any tunnel data the proxy sends in
+// the same packet as the CONNECT response.
+type httpConnectDialer struct {
+	forward   proxy.Dialer
+	proxyAddr string
+	auth      proxyAuthenticator // auth authenticates to the proxy if it is set
+	tlsConfig *tls.Config        // tlsConfig is used to connect to the proxy with TLS if it is set
+}
+
+// newHTTPConnectDialer implements the proxy.RegisterDialerType constructor for
+// HTTP proxies.
+func newHTTPConnectDialer(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return newConnectDialer(proxyURL, forward, defaultHTTPProxyPort)
+}
+
+// newHTTPSConnectDialer implements the proxy.RegisterDialerType constructor for
+// HTTP proxies which are connected to with TLS.
+func newHTTPSConnectDialer(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	dialer, err := newConnectDialer(proxyURL, forward, defaultHTTPSProxyPort)
+	if err != nil {
+		return nil, err
+	}
+	dialer.tlsConfig = &tls.Config{
+		ServerName: proxyURL.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	return dialer, nil
+}
+
+// newConnectDialer builds an httpConnectDialer for proxyURL.
+func newConnectDialer(proxyURL *url.URL, forward proxy.Dialer, defaultPort string) (*httpConnectDialer, error) {
+	port := proxyURL.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	// Credentials in the URL default to basic authentication.
+	auth, err := newProxyAuthenticator(config.ProxyAuth{}, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return &httpConnectDialer{
+		forward:   forward,
+		proxyAddr: net.JoinHostPort(proxyURL.Hostname(), port),
+		auth:      auth,
+	}, nil
+}
+
+// Dial implements proxy.Dialer.
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.Errorf("http proxy: network type %q unsupported", network)
+	}
+
+	conn, err := dialForward(ctx, d.forward, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "http proxy: failed dialing proxy %s", d.proxyAddr)
+	}
+
+	// Abort the handshake if the context is cancelled.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+
+	tunnel, err := d.handshake(ctx, conn, addr)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// handshake starts TLS with the proxy if needed and then opens the tunnel.
+func (d *httpConnectDialer) handshake(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, errors.Wrapf(err, "http proxy: TLS handshake with proxy %s failed", d.proxyAddr)
+		}
+		conn = tlsConn
+	}
+	return d.connect(conn, addr)
+}
+
+// configureTLS applies the TLS configuration of a proxy hop.
+func (d *httpConnectDialer) configureTLS(cfg config.ProxyTLS) {
+	if d.tlsConfig == nil {
+		return
+	}
+	//nolint:gosec
+	d.tlsConfig.InsecureSkipVerify = cfg.NoVerify
+	d.tlsConfig.RootCAs = cfg.CACerts.CertPool
+	if cfg.ServerNameIndication != nil {
+		d.tlsConfig.ServerName = *cfg.ServerNameIndication
+	}
+	if cfg.ClientCertificate != nil {
+		d.tlsConfig.Certificates = []tls.Certificate{*cfg.ClientCertificate.Certificate}
+	}
+}
+
+// connect sends the CONNECT request for addr on conn and reads the response,
+// answering any authentication challenges on the same connection.
+func (d *httpConnectDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	var authorization string
+	if d.auth != nil {
+		var err error
+		if authorization, err = d.auth.initial(); err != nil {
+			return nil, errors.Wrapf(err, "http proxy: %s", d.proxyAddr)
+		}
+	}
+
+	reader := bufio.NewReader(conn)
+	for round := 1; ; round++ {
+		if authorization != "" {
+			request.Header.Set("Proxy-Authorization", authorization)
+		}
+
+		resp, err := roundTripConnect(conn, reader, request)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return bufferedConn(conn, reader), nil
+		case resp.StatusCode != http.StatusProxyAuthRequired:
+			return nil, errors.Wrapf(ErrProxyConnectFailed, "%s: %s", d.proxyAddr, resp.Status)
+		case d.auth == nil:
+			return nil, errors.Wrapf(ErrProxyAuthRequired, "%s: %s", d.proxyAddr,
+				strings.Join(resp.Header.Values("Proxy-Authenticate"), ", "))
+		case resp.Close || round >= maxProxyAuthRounds:
+			return nil, errors.Wrapf(ErrProxyAuthRequired, "%s: authentication did not complete: %s", d.proxyAddr,
+				strings.Join(resp.Header.Values("Proxy-Authenticate"), ", "))
+		}
+
+		if authorization, err = d.auth.respond(resp.Header.Values("Proxy-Authenticate")); err != nil {
+			return nil, errors.Wrapf(err, "http proxy: %s", d.proxyAddr)
+		}
+	}
+}
+
+// roundTripConnect writes request to conn and reads the response header. Any
+// response body is discarded so the connection can be reused.
+func roundTripConnect(conn net.Conn, reader *bufio.Reader, request *http.Request) (*http.Response, error) {
+	if err := request.Write(conn); err != nil {
+		return nil, errors.Wrap(err, "http proxy: failed writing CONNECT request")
+	}
+	resp, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, errors.Wrap(err, "http proxy: failed reading CONNECT response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	return resp, nil
+}
+
+// bufferedConn returns conn, replaying any data which was read past the end of
+// the proxy response first.
+func bufferedConn(conn net.Conn, reader *bufio.Reader) net.Conn {
+	if reader.Buffered() == 0 {
+		return conn
+	}
+	buffered, _ := reader.Peek(reader.Buffered())
+	return &peekedConn{reader: io.MultiReader(bytes.NewReader(buffered), conn), Conn: conn}
+}
+
+// dialForward dials addr with forward, using the context if it supports it.
+func dialForward(ctx context.Context, forward proxy.Dialer, network, addr string) (net.Conn, error) {
+	if contextDialer, ok := forward.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, network, addr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := forward.Dial(network, addr)
+		done <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
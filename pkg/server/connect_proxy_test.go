@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// fakeConnectProxy is an HTTP proxy which passes each CONNECT request to
+// handle, and records the client address of every request it receives.
+type fakeConnectProxy struct {
+	*httptest.Server
+	handle func(w http.ResponseWriter, r *http.Request, round int)
+
+	mu          sync.Mutex
+	remoteAddrs []string
+	headers     []http.Header
+}
+
+func newFakeConnectProxy(t *testing.T, handle func(w http.ResponseWriter, r *http.Request, round int)) *fakeConnectProxy {
+	t.Helper()
+	p := &fakeConnectProxy{handle: handle}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		p.mu.Lock()
+		p.remoteAddrs = append(p.remoteAddrs, r.RemoteAddr)
+		p.headers = append(p.headers, r.Header.Clone())
+		round := len(p.remoteAddrs)
+		p.mu.Unlock()
+		p.handle(w, r, round)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// requests returns the client addresses and headers of the requests received.
+func (p *fakeConnectProxy) requests() ([]string, []http.Header) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.remoteAddrs...), append([]http.Header{}, p.headers...)
+}
+
+// dialer returns a CONNECT dialer for the proxy with the given credentials.
+func (p *fakeConnectProxy) dialer(t *testing.T, user *url.Userinfo) *httpConnectDialer {
+	t.Helper()
+	proxyURL, err := url.Parse(p.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = user
+	dialer, err := newHTTPConnectDialer(proxyURL, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectDialer, ok := dialer.(*httpConnectDialer)
+	if !ok {
+		t.Fatalf("unexpected dialer type %T", dialer)
+	}
+	return connectDialer
+}
+
+// acceptTunnel hijacks the connection, accepts the CONNECT request and writes
+// greeting straight after the response.
+func acceptTunnel(t *testing.T, w http.ResponseWriter, greeting string) {
+	t.Helper()
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go func() {
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n" + greeting)
+		_ = buf.Flush()
+		// Echo everything sent through the tunnel.
+		_, _ = io.Copy(conn, buf)
+	}()
+}
+
+func dialContext(t *testing.T, d *httpConnectDialer) (net.Conn, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return d.DialContext(ctx, "tcp", "backend.internal:443")
+}
+
+func TestConnectDialerTunnel(t *testing.T) {
+	p := newFakeConnectProxy(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+		if r.Host != "backend.internal:443" {
+			t.Errorf("unexpected CONNECT target %q", r.Host)
+		}
+		// The greeting arrives with the response, as for server-speaks-first
+		// protocols such as SSH.
+		acceptTunnel(t, w, "greeting\n")
+	})
+
+	conn, err := dialContext(t, p.dialer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadString('\n')
+	if err != nil || greeting != "greeting\n" {
+		t.Fatalf("expected greeting sent with the response, got %q: %v", greeting, err)
+	}
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	echo, err := reader.ReadString('\n')
+	if err != nil || echo != "ping\n" {
+		t.Fatalf("expected echo through the tunnel, got %q: %v", echo, err)
+	}
+
+	_, headers := p.requests()
+	if value := headers[0].Get("Proxy-Authorization"); value != "" {
+		t.Errorf("expected no Proxy-Authorization without credentials, got %q", value)
+	}
+}
+
+func TestConnectDialerBasicAuth(t *testing.T) {
+	p := newFakeConnectProxy(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+		acceptTunnel(t, w, "")
+	})
+
+	conn, err := dialContext(t, p.dialer(t, url.UserPassword("bob", "secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	_, headers := p.requests()
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:secret"))
+	if value := headers[0].Get("Proxy-Authorization"); value != expected {
+		t.Errorf("expected credentials from the proxy URL to be sent, got %q", value)
+	}
+}
+
+func TestConnectDialerBasicAuthRejected(t *testing.T) {
+	p := newFakeConnectProxy(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	})
+
+	_, err := dialContext(t, p.dialer(t, url.UserPassword("bob", "wrong")))
+	if !errors.Is(err, ErrProxyAuthRequired) {
+		t.Fatalf("expected ErrProxyAuthRequired, got %v", err)
+	}
+	if addrs, _ := p.requests(); len(addrs) != 1 {
+		t.Errorf("expected rejected basic credentials not to be resent, got %d requests", len(addrs))
+	}
+}
+
+func TestConnectDialerAuthRequired(t *testing.T) {
+	p := newFakeConnectProxy(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	})
+
+	_, err := dialContext(t, p.dialer(t, nil))
+	if !errors.Is(err, ErrProxyAuthRequired) {
+		t.Fatalf("expected ErrProxyAuthRequired, got %v", err)
+	}
+}
+
+func TestConnectDialerRefused(t *testing.T) {
+	p := newFakeConnectProxy(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	_, err := dialContext(t, p.dialer(t, nil))
+	if !errors.Is(err, ErrProxyConnectFailed) {
+		t.Fatalf("expected ErrProxyConnectFailed, got %v", err)
+	}
+}
+
+func TestConnectDialerContextCancelled(t *testing.T) {
+	release := make(chan struct{})
+	p := newFakeConnectProxy(t, func(_ http.ResponseWriter, _ *http.Request, _ int) {
+		<-release
+	})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := p.dialer(t, nil).DialContext(ctx, "tcp", "backend.internal:443")
+	if err == nil {
+		t.Fatal("expected the handshake to be aborted by the context")
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+const defaultFailoverRaceDelay = 250 * time.Millisecond
+
+var (
+	ErrUnknownFailoverMode = errors.New("unknown proxychain failover mode")
+)
+
+// failoverProxychain dials through one of several alternative proxychains. The
+// alternative which last worked is always tried first.
+type failoverProxychain struct {
+	logger    *zap.Logger
+	mode      config.FailoverMode
+	raceDelay time.Duration
+	chains    []*proxychain
+	preferred atomic.Int32 // preferred is the index of the last working alternative
+}
+
+// newFailoverProxychain builds a proxychain for each alternative in cfg.
+func newFailoverProxychain(name string, cfg config.ProxychainConfig) (*failoverProxychain, error) {
+	switch cfg.Failover {
+	case "", config.FailoverOrdered, config.FailoverRace:
+	default:
+		return nil, errors.Wrapf(ErrUnknownFailoverMode, "%v", cfg.Failover)
+	}
+
+	f := &failoverProxychain{
+		logger:    zap.L().With(zap.String("failover", string(cfg.Failover))),
+		mode:      cfg.Failover,
+		raceDelay: cfg.RaceDelay,
+	}
+	if f.raceDelay == 0 {
+		f.raceDelay = defaultFailoverRaceDelay
+	}
+
+	for idx, alternative := range cfg.Alternatives {
+		chain, err := newProxychain(name, alternative)
+		if err != nil {
+			return nil, errors.Wrapf(err, "proxychain alternative %v", idx)
+		}
+		f.chains = append(f.chains, chain)
+	}
+	return f, nil
+}
+
+// Dialer implements Proxychain.
+func (f *failoverProxychain) Dialer() proxy.ContextDialer {
+	return f
+}
+
+// order returns the alternatives in the order they should be tried.
+func (f *failoverProxychain) order() []int {
+	preferred := int(f.preferred.Load())
+	order := make([]int, 0, len(f.chains))
+	order = append(order, preferred)
+	for idx := range f.chains {
+		if idx != preferred {
+			order = append(order, idx)
+		}
+	}
+	return order
+}
+
+// succeeded remembers idx as the working alternative.
+func (f *failoverProxychain) succeeded(idx int) {
+	if previous := f.preferred.Swap(int32(idx)); int(previous) != idx {
+		f.logger.Info("Proxychain failed over to alternative", zap.Int("from", int(previous)), zap.Int("to", idx))
+	}
+}
+
+// DialContext implements proxy.ContextDialer.
+func (f *failoverProxychain) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if f.mode == config.FailoverRace {
+		return f.race(ctx, network, addr)
+	}
+	return f.ordered(ctx, network, addr)
+}
+
+// ordered tries each alternative in turn until one connects.
+func (f *failoverProxychain) ordered(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, idx := range f.order() {
+		conn, err := f.chains[idx].Dialer().DialContext(ctx, network, addr)
+		if err == nil {
+			f.succeeded(idx)
+			return conn, nil
+		}
+		f.logger.Debug("Proxychain alternative failed", zap.Int("alternative", idx),
+			zap.String("target_addr", addr), zap.Error(err))
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Wrap(lastErr, "all proxychain alternatives failed")
+}
+
+// race starts dialing the alternatives in turn, staggered by the race delay, and
+// uses the first which connects. A failed dial starts the next immediately.
+func (f *failoverProxychain) race(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		idx  int
+		conn net.Conn
+		err  error
+	}
+
+	order := f.order()
+	results := make(chan result, len(order))
+	started := 0
+	pending := 0
+	startNext := func() {
+		idx := order[started]
+		started++
+		pending++
+		go func() {
+			conn, err := f.chains[idx].Dialer().DialContext(ctx, network, addr)
+			results <- result{idx: idx, conn: conn, err: err}
+		}()
+	}
+
+	timer := time.NewTimer(f.raceDelay)
+	defer timer.Stop()
+
+	startNext()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if started < len(order) {
+				startNext()
+				timer.Reset(f.raceDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				f.succeeded(r.idx)
+				// Close the connections of any dials which also succeed.
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			f.logger.Debug("Proxychain alternative failed", zap.Int("alternative", r.idx),
+				zap.String("target_addr", addr), zap.Error(r.err))
+			lastErr = r.err
+			if started < len(order) && ctx.Err() == nil {
+				startNext()
+				timer.Reset(f.raceDelay)
+			}
+		}
+	}
+	return nil, errors.Wrap(lastErr, "all proxychain alternatives failed")
+}
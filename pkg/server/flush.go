@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const copyBufferSize = 32 * 1024
+
+// flushWriter wraps a ResponseWriter and flushes written data to the client. A
+// negative interval flushes after every write, otherwise flushes are delayed by
+// at most interval after a write.
+type flushWriter struct {
+	writer     io.Writer
+	controller *http.ResponseController
+	interval   time.Duration
+
+	mu           sync.Mutex
+	timer        *time.Timer
+	flushPending bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.writer.Write(p)
+	if err != nil {
+		return n, errors.Wrap(err, "flushWriter.Write")
+	}
+
+	if f.interval < 0 {
+		_ = f.controller.Flush()
+		return n, nil
+	}
+
+	if f.flushPending {
+		return n, nil
+	}
+	if f.timer == nil {
+		f.timer = time.AfterFunc(f.interval, f.delayedFlush)
+	} else {
+		f.timer.Reset(f.interval)
+	}
+	f.flushPending = true
+	return n, nil
+}
+
+func (f *flushWriter) delayedFlush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Stop may have been called already
+	if !f.flushPending {
+		return
+	}
+	_ = f.controller.Flush()
+	f.flushPending = false
+}
+
+// stop cancels any pending flush.
+func (f *flushWriter) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushPending = false
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
+
+// copyResponse copies the body to the ResponseWriter. A flushInterval of zero
+// only flushes once the body is finished.
+func copyResponse(writer http.ResponseWriter, body io.Reader, flushInterval time.Duration) error {
+	var dst io.Writer = writer
+	if flushInterval != 0 {
+		fw := &flushWriter{
+			writer:     writer,
+			controller: http.NewResponseController(writer),
+			interval:   flushInterval,
+		}
+		defer fw.stop()
+		dst = fw
+	}
+
+	buf := make([]byte, copyBufferSize)
+	_, err := io.CopyBuffer(dst, body, buf)
+	if err != nil {
+		return errors.Wrap(err, "copyResponse")
+	}
+	return nil
+}
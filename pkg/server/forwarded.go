@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+// forwardingHeaders are the request headers which describe the original client.
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"Forwarded",
+}
+
+// forwarder adds client information to outbound requests.
+type forwarder struct {
+	cfg config.ForwardedHeaders
+}
+
+// enabled returns true if any forwarding header is configured.
+func (f forwarder) enabled() bool {
+	return f.cfg.XForwardedFor || f.cfg.XForwardedProto || f.cfg.XForwardedHost || f.cfg.Forwarded
+}
+
+// trusted returns true if the client address is a trusted proxy whose
+// forwarding headers should be kept.
+func (f forwarder) trusted(clientIP netip.Addr) bool {
+	for _, prefix := range f.cfg.TrustedProxies {
+		if prefix.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the forwarding headers on outbound based on the original request.
+// Incoming forwarding headers are stripped unless the client is a trusted proxy.
+func (f forwarder) apply(outbound *http.Request, request *http.Request) {
+	if !f.enabled() {
+		return
+	}
+
+	clientHost, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		clientHost = request.RemoteAddr
+	}
+	// An unparseable address (e.g. a unix socket) leaves clientIP invalid,
+	// which is reported as "unknown" rather than a bogus address.
+	clientIP, err := netip.ParseAddr(clientHost)
+	if err != nil {
+		clientIP = netip.Addr{}
+	}
+	clientIP = clientIP.Unmap()
+
+	if !f.trusted(clientIP) {
+		for _, name := range forwardingHeaders {
+			outbound.Header.Del(name)
+		}
+	}
+
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+
+	if f.cfg.XForwardedFor && clientIP.IsValid() {
+		if prior := outbound.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			outbound.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP.String())
+		} else {
+			outbound.Header.Set("X-Forwarded-For", clientIP.String())
+		}
+	}
+
+	if f.cfg.XForwardedProto && outbound.Header.Get("X-Forwarded-Proto") == "" {
+		outbound.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if f.cfg.XForwardedHost && outbound.Header.Get("X-Forwarded-Host") == "" {
+		outbound.Header.Set("X-Forwarded-Host", request.Host)
+	}
+
+	if f.cfg.Forwarded {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s",
+			forwardedNode(clientIP), forwardedValue(request.Host), proto)
+		if prior := outbound.Header.Values("Forwarded"); len(prior) > 0 {
+			outbound.Header.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+		} else {
+			outbound.Header.Set("Forwarded", element)
+		}
+	}
+}
+
+// forwardedNode formats an address as an RFC 7239 node identifier.
+func forwardedNode(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return "unknown"
+	}
+	if addr.Is6() {
+		return fmt.Sprintf("\"[%s]\"", addr.String())
+	}
+	return addr.String()
+}
+
+// forwardedValue quotes an RFC 7239 value if it is not a valid token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return fmt.Sprintf("%q", value)
+		}
+	}
+	return value
+}
+
+// isTokenChar reports whether c is an RFC 7230 tchar.
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"golang.org/x/net/http/httpguts"
+)
+
+var (
+	ErrUnknownHostHeaderMode = errors.New("unknown host_header mode")
+	ErrHostHeaderValueNeeded = errors.New("host_header mode fixed requires a value")
+)
+
+// hopByHopHeaders are the connection specific headers defined by RFC 9110 which
+// must not be forwarded by proxies.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including any headers
+// named by the Connection header, from header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// removeRequestHopByHopHeaders strips hop-by-hop headers from an outbound request
+// while keeping what is needed for trailers and protocol upgrades.
+func removeRequestHopByHopHeaders(header http.Header) {
+	upgrade := ""
+	if httpguts.HeaderValuesContainsToken(header.Values("Connection"), "upgrade") {
+		upgrade = header.Get("Upgrade")
+	}
+	// TE: trailers is end-to-end in practice (gRPC depends on it).
+	keepTrailers := httpguts.HeaderValuesContainsToken(header.Values("Te"), "trailers")
+
+	removeHopByHopHeaders(header)
+
+	if keepTrailers {
+		header.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", upgrade)
+	}
+}
+
+// hostHeader selects the Host header sent to the backend.
+type hostHeader struct {
+	mode  config.HostHeaderMode
+	value string
+}
+
+func newHostHeader(cfg config.HostHeader) (hostHeader, error) {
+	switch cfg.Mode {
+	case "", config.HostHeaderTarget, config.HostHeaderPreserve:
+	case config.HostHeaderFixed:
+		if cfg.Value == "" {
+			return hostHeader{}, ErrHostHeaderValueNeeded
+		}
+	default:
+		return hostHeader{}, errors.Wrapf(ErrUnknownHostHeaderMode, "%v", cfg.Mode)
+	}
+	return hostHeader{mode: cfg.Mode, value: cfg.Value}, nil
+}
+
+// get returns the Host to send for the request. An empty string means the
+// target address is used.
+func (h hostHeader) get(request *http.Request) string {
+	switch h.mode {
+	case config.HostHeaderPreserve:
+		return request.Host
+	case config.HostHeaderFixed:
+		return h.value
+	default:
+		return ""
+	}
+}
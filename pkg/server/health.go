@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckPath               = "/"
+	defaultHealthCheckInterval           = 10 * time.Second
+	defaultHealthCheckTimeout            = 5 * time.Second
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 3
+	defaultPassiveEjectDuration          = 30 * time.Second
+)
+
+var (
+	ErrHealthCheckUnexpectedStatus = errors.New("health check returned unexpected status")
+)
+
+// targetHealth is the health state of a single backend target.
+type targetHealth struct {
+	addr string
+
+	activeHealthy       atomic.Bool  // activeHealthy is the result of active health checks
+	consecutiveFailures atomic.Int32 // consecutiveFailures counts failed requests for passive ejection
+	ejectedUntil        atomic.Int64 // ejectedUntil is the UnixNano time passive ejection ends
+
+	// These are only accessed by the active check goroutine
+	checkSuccesses int
+	checkFailures  int
+}
+
+// healthTracker tracks the health of the configured targets of a backend from
+// active health checks and passively from request results.
+type healthTracker struct {
+	logger  *zap.Logger
+	cfg     config.HealthCheck
+	targets map[string]*targetHealth
+}
+
+// newHealthTracker initializes health tracking for addrs. Returns nil if health
+// checking is not configured.
+func newHealthTracker(cfg config.HealthCheck, addrs []string) *healthTracker {
+	if !cfg.Active.Enable && cfg.Passive.MaxFailures == 0 {
+		return nil
+	}
+
+	t := &healthTracker{
+		logger:  zap.L().With(zap.String("component", "health_check")),
+		cfg:     cfg,
+		targets: make(map[string]*targetHealth),
+	}
+	for _, addr := range addrs {
+		health := &targetHealth{addr: addr}
+		health.activeHealthy.Store(true)
+		t.targets[addr] = health
+	}
+	return t
+}
+
+// Healthy returns true if the target should receive requests. Targets which are
+// not tracked are always healthy.
+func (t *healthTracker) Healthy(addr string) bool {
+	if t == nil {
+		return true
+	}
+	health, found := t.targets[addr]
+	if !found {
+		return true
+	}
+	return health.activeHealthy.Load() && time.Now().UnixNano() >= health.ejectedUntil.Load()
+}
+
+// ReportSuccess records a successful request to the target.
+func (t *healthTracker) ReportSuccess(addr string) {
+	if t == nil {
+		return
+	}
+	if health, found := t.targets[addr]; found {
+		health.consecutiveFailures.Store(0)
+	}
+}
+
+// ReportFailure records a failed request to the target and ejects it once the
+// configured number of consecutive failures is reached.
+func (t *healthTracker) ReportFailure(addr string) {
+	if t == nil || t.cfg.Passive.MaxFailures == 0 {
+		return
+	}
+	health, found := t.targets[addr]
+	if !found {
+		return
+	}
+	if health.consecutiveFailures.Add(1) < int32(t.cfg.Passive.MaxFailures) {
+		return
+	}
+
+	ejectDuration := t.cfg.Passive.EjectDuration
+	if ejectDuration == 0 {
+		ejectDuration = defaultPassiveEjectDuration
+	}
+	health.consecutiveFailures.Store(0)
+	health.ejectedUntil.Store(time.Now().Add(ejectDuration).UnixNano())
+	t.logger.Warn("Ejecting target after consecutive failures", zap.String("target_addr", addr),
+		zap.Uint("failures", t.cfg.Passive.MaxFailures), zap.Duration("eject_duration", ejectDuration))
+}
+
+// IsFailureStatus returns true if the response status counts as a passive failure.
+func (t *healthTracker) IsFailureStatus(status int) bool {
+	if t == nil {
+		return false
+	}
+	return slices.Contains(t.cfg.Passive.FailureStatus, status)
+}
+
+// Start runs active health checks with check until the context is cancelled.
+func (t *healthTracker) Start(ctx context.Context, check func(ctx context.Context, addr string) error) {
+	if t == nil || !t.cfg.Active.Enable {
+		return
+	}
+
+	interval := t.cfg.Active.Interval
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	for _, health := range t.targets {
+		go func(health *targetHealth) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				t.runCheck(ctx, health, check)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(health)
+	}
+}
+
+// runCheck performs a single active check and updates the target state.
+func (t *healthTracker) runCheck(ctx context.Context, health *targetHealth,
+	check func(ctx context.Context, addr string) error) {
+	timeout := t.cfg.Active.Timeout
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	healthyThreshold := t.cfg.Active.HealthyThreshold
+	if healthyThreshold == 0 {
+		healthyThreshold = defaultHealthCheckHealthyThreshold
+	}
+	unhealthyThreshold := t.cfg.Active.UnhealthyThreshold
+	if unhealthyThreshold == 0 {
+		unhealthyThreshold = defaultHealthCheckUnhealthyThreshold
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	err := check(checkCtx, health.addr)
+	cancel()
+
+	logger := t.logger.With(zap.String("target_addr", health.addr))
+	if err != nil {
+		logger.Debug("Health check failed", zap.Error(err))
+		health.checkSuccesses = 0
+		health.checkFailures++
+		if health.activeHealthy.Load() && health.checkFailures >= int(unhealthyThreshold) {
+			logger.Warn("Target is unhealthy", zap.Error(err))
+			health.activeHealthy.Store(false)
+		}
+		return
+	}
+
+	health.checkFailures = 0
+	health.checkSuccesses++
+	if !health.activeHealthy.Load() && health.checkSuccesses >= int(healthyThreshold) {
+		logger.Info("Target is healthy")
+		health.activeHealthy.Store(true)
+	}
+}
+
+// healthCheck implements an active HTTP health check against a backend target.
+func (h HTTPBackend) healthCheck(ctx context.Context, addr string) error {
+	scheme := "http"
+	if h.tls.Enable {
+		scheme = "https"
+	}
+
+	path := h.healthCheckConfig.Path
+	if path == "" {
+		path = defaultHealthCheckPath
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s", scheme, addr, path), nil)
+	if err != nil {
+		return errors.Wrap(err, "healthCheck")
+	}
+	// Use the same Host as requests from clients. Probes have no client, so
+	// preserve sends the target address.
+	if host := h.hostHeader.get(request); host != "" {
+		request.Host = host
+	}
+	if host := h.setHeaders.Get("Host"); host != "" {
+		request.Host = host
+	}
+
+	resp, err := h.transports.Get(h.transportKey(addr)).RoundTrip(request)
+	if err != nil {
+		return errors.Wrap(err, "healthCheck")
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if len(h.healthCheckConfig.ExpectedStatus) == 0 {
+		if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+			return errors.Wrapf(ErrHealthCheckUnexpectedStatus, "%v", resp.StatusCode)
+		}
+		return nil
+	}
+	if !slices.Contains(h.healthCheckConfig.ExpectedStatus, resp.StatusCode) {
+		return errors.Wrapf(ErrHealthCheckUnexpectedStatus, "%v", resp.StatusCode)
+	}
+	return nil
+}
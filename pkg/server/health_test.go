@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+func TestHealthCheckUsesHostHeader(t *testing.T) {
+	const vhost = "app.example"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != vhost {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	host, portStr, err := net.SplitHostPort(backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := NewProxychainFromConfig("test", config.ProxychainConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cfg     config.BackendConfig
+		healthy bool
+	}{
+		{"target", config.BackendConfig{}, false},
+		{"fixed", config.BackendConfig{
+			HostHeader: config.HostHeader{Mode: config.HostHeaderFixed, Value: vhost},
+		}, true},
+		{"set_headers precedence", config.BackendConfig{
+			HostHeader:  config.HostHeader{Mode: config.HostHeaderFixed, Value: "other.example"},
+			HTTPHeaders: config.HTTPHeaders{SetHeaders: map[string][]string{"Host": {vhost}}},
+		}, true},
+	} {
+		tc.cfg.Target = config.HostSpec{Host: host, Port: uint16(port)}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		h, err := NewHTTPBackend(ctx, tc.cfg, chain)
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		err = h.healthCheck(ctx, tc.cfg.Target.HostPort())
+		cancel()
+		if tc.healthy && err != nil {
+			t.Errorf("%s: expected the probe to reach the vhost: %v", tc.name, err)
+		}
+		if !tc.healthy && err == nil {
+			t.Errorf("%s: expected the probe to miss the vhost", tc.name)
+		}
+	}
+}
+
+func TestPassiveHealthEjectsHungTarget(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	chain, err := NewProxychainFromConfig("test", config.ProxychainConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := testHostSpec(t, backend.Listener.Addr().String())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := NewHTTPBackend(ctx, config.BackendConfig{
+		Target:         target,
+		HealthCheck:    config.HealthCheck{Passive: config.PassiveHealthCheck{MaxFailures: 2}},
+		CircuitBreaker: config.CircuitBreaker{FailureThreshold: 2},
+		Timeouts:       config.BackendTimeouts{Request: 50 * time.Millisecond},
+	}, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		if recorder.Code != http.StatusGatewayTimeout {
+			t.Fatalf("expected the request to time out, got %v", recorder.Code)
+		}
+	}
+
+	status := h.TargetStatus()
+	if len(status) != 1 || status[0].Healthy {
+		t.Errorf("expected the hung target to be ejected, got %+v", status)
+	}
+	if len(status) == 1 && status[0].Circuit != CircuitOpen.String() {
+		t.Errorf("expected the circuit of the hung target to open, got %+v", status)
+	}
+}
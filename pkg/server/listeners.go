@@ -2,85 +2,168 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
-	"strings"
-
-	"github.com/samber/lo"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/MadAppGang/httplog"
 	lzap "github.com/MadAppGang/httplog/zap"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
 	"go.uber.org/zap"
 )
 
-const wildcardMatch = "*"
+// httpListenerDrainDelay is how long a closed HTTP listener waits for requests
+// on connections it has already accepted before it shuts down.
+const httpListenerDrainDelay = 5 * time.Second
+
+var (
+	ErrSiteCertificateMissing = errors.New("site has no certificate configured for TLS listener")
+	ErrSiteNotHTTP            = errors.New("site has no HTTP backend")
+	ErrNoSNIProvided          = errors.New("client did not send a TLS server name")
+	ErrNoCertificateForHost   = errors.New("no certificate found for TLS server name")
+	ErrSiteNotFound           = errors.New("site not found")
+	ErrListenerHandoverFailed = errors.New("could not hand the listener socket over")
+)
 
 type Listener interface {
-	AddSite(host string, backend http.Handler) error
+	AddSite(site *Site) error
+	// SetSites replaces all the sites of the listener. The new sites are
+	// validated first, and connections are switched over to them atomically.
+	SetSites(sites []*Site) error
+	// RemoveSite detaches the site for host. Lookups which are in progress are
+	// not affected.
+	RemoveSite(host string) error
+	// Close stops accepting connections. Connections which are already open are
+	// allowed to finish in the background.
+	Close() error
 }
 
-// matcher encodes the trie structure used for resolving wildcard domains.
-type matcher struct {
-	backend  http.Handler
-	subtrees map[string]*matcher
+// edgeRoutes are the lookup tries of an HTTPEdgeListener. They are never
+// modified once built, so lookups need no locking.
+type edgeRoutes struct {
+	sites        *matcher[*Site]
+	certificates *matcher[*tls.Certificate] // certificates is only populated for TLS listeners
 }
 
 type HTTPEdgeListener struct {
-	logger   *zap.Logger
-	server   *http.Server
-	backends *matcher
+	logger    *zap.Logger
+	name      string
+	key       listenerKey
+	metrics   *serverMetrics
+	server    *http.Server
+	enableTLS bool
+
+	mu       sync.Mutex // mu serializes changes to the sites
+	sites    []*Site
+	routes   atomic.Pointer[edgeRoutes]
+	listener *closeNotifyListener
+	shutdown sync.Once
 }
 
-func (l *HTTPEdgeListener) AddSite(host string, backend http.Handler) error {
-	hostComponents := lo.Reverse(strings.Split(host, "."))
-	currentMatcher := l.backends
-	for _, domain := range hostComponents {
-		if nextMatcher, found := currentMatcher.subtrees[domain]; found {
-			currentMatcher = nextMatcher
-		} else {
-			currentMatcher.subtrees[domain] = &matcher{backend: nil, subtrees: make(map[string]*matcher)}
-			currentMatcher = currentMatcher.subtrees[domain]
+// buildRoutes builds the lookup tries for sites.
+func (l *HTTPEdgeListener) buildRoutes(sites []*Site) (*edgeRoutes, error) {
+	routes := &edgeRoutes{sites: newMatcher[*Site]()}
+	if l.enableTLS {
+		routes.certificates = newMatcher[*tls.Certificate]()
+	}
+
+	for _, site := range sites {
+		if site.Handler == nil {
+			return nil, errors.Wrapf(ErrSiteNotHTTP, "%v", site.Host)
+		}
+
+		if routes.certificates != nil {
+			if site.Config.Certificate == nil {
+				return nil, errors.Wrapf(ErrSiteCertificateMissing, "%v", site.Host)
+			}
+			if routes.certificates.add(site.Host, site.Config.Certificate.Certificate) {
+				l.logger.Warn("Site certificate already exists but is being overridden", zap.String("host", site.Host))
+			}
+		}
+
+		// This should never happen since the check is made before sites are added. So just warn here - we might change
+		// semantics someday, but it's not fatal just unexpected.
+		if routes.sites.add(site.Host, site) {
+			l.logger.Warn("Site backend already exists but is being overridden", zap.String("host", site.Host))
 		}
 	}
 
-	// This should never happen since the check is made before AddSite is called. So just warn here - we might change
-	// semantics someday, but it's not fatal just unexpected.
-	if currentMatcher.backend != nil {
-		l.logger.Warn("Site backend already exists but is being overridden", zap.String("host", host))
+	return routes, nil
+}
+
+// setSitesLocked replaces the sites. l.mu must be held.
+func (l *HTTPEdgeListener) setSitesLocked(sites []*Site) error {
+	routes, err := l.buildRoutes(sites)
+	if err != nil {
+		return err
 	}
+	l.sites = sites
+	l.routes.Store(routes)
+	return nil
+}
+
+// AddSite implements Listener.
+func (l *HTTPEdgeListener) AddSite(site *Site) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.setSitesLocked(append(append([]*Site{}, l.sites...), site))
+}
 
-	currentMatcher.backend = backend
+// SetSites implements Listener.
+func (l *HTTPEdgeListener) SetSites(sites []*Site) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.setSitesLocked(append([]*Site{}, sites...))
+}
+
+// RemoveSite implements Listener. The site is pruned from copies of the tries
+// which then replace the current ones.
+func (l *HTTPEdgeListener) RemoveSite(host string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
+	sites := lo.Reject(l.sites, func(site *Site, _ int) bool { return site.Host == host })
+	if len(sites) == len(l.sites) {
+		return errors.Wrapf(ErrSiteNotFound, "%v", host)
+	}
+
+	routes := l.routes.Load()
+	l.sites = sites
+	l.routes.Store(&edgeRoutes{
+		sites:        routes.sites.without(host),
+		certificates: routes.certificates.without(host),
+	})
 	return nil
 }
 
-// matchSite tries to find a target host in the backends.
-func (l *HTTPEdgeListener) matchSite(host string) http.Handler {
-	hostComponents := lo.Reverse(strings.Split(host, "."))
-	currentMatcher := l.backends
-	wasWildCard := false
-	for _, domain := range hostComponents {
-		if nextMatcher, found := currentMatcher.subtrees[domain]; found {
-			currentMatcher = nextMatcher
-			wasWildCard = false
-			continue
-		}
-		// No match - but is there a wildcard?
-		if nextMatcher, found := currentMatcher.subtrees[wildcardMatch]; found {
-			currentMatcher = nextMatcher
-			wasWildCard = true
-			continue
-		}
-		// No match, but was the last match a wildcard?
-		if wasWildCard {
-			continue
-		}
-		// No match at all. Stop.
-		break
+// matchSite tries to find the site for a target host.
+func (l *HTTPEdgeListener) matchSite(host string) *Site {
+	site, _ := l.routes.Load().sites.match(host)
+	return site
+}
+
+// getCertificate implements tls.Config.GetCertificate by selecting the site
+// certificate using the SNI name sent by the client.
+func (l *HTTPEdgeListener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		l.logger.Debug("Client did not send SNI", zap.String("remote_addr", hello.Conn.RemoteAddr().String()))
+		return nil, ErrNoSNIProvided
+	}
+
+	cert, found := l.routes.Load().certificates.match(hello.ServerName)
+	if !found {
+		l.logger.Debug("No certificate for server name", zap.String("server_name", hello.ServerName))
+		return nil, errors.Wrapf(ErrNoCertificateForHost, "%v", hello.ServerName)
 	}
 
-	return currentMatcher.backend
+	return cert, nil
 }
 
 // handler implements HandlerFunc.
@@ -91,8 +174,8 @@ func (l *HTTPEdgeListener) handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Try a direct lookup
-	backend := l.matchSite(hostname)
-	if backend == nil {
+	site := l.matchSite(hostname)
+	if site == nil {
 		// Bad gateway
 		l.logger.Debug("Host is not known", zap.String("hostname", hostname))
 		r.Body.Close()
@@ -100,34 +183,67 @@ func (l *HTTPEdgeListener) handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Dispatch to the correct backend
-	backend.ServeHTTP(w, r)
+	l.metrics.serveHTTP(l.name, site, w, r)
 }
 
-func NewHTTPEdgeListener(ctx context.Context, cfg listenerKey) (Listener, error) {
+// newHTTPEdgeListener initializes an HTTPEdgeListener without starting it.
+// Requests are recorded in metrics under name if metrics is not nil.
+func newHTTPEdgeListener(name string, cfg listenerKey, timeouts config.ListenerTimeouts, enableTLS bool,
+	metrics *serverMetrics,
+) *HTTPEdgeListener {
 	r := &HTTPEdgeListener{
-		logger:   zap.L().With(zap.String("addr", cfg.Addr.String()), zap.String("network", cfg.Network)),
-		backends: &matcher{backend: nil, subtrees: make(map[string]*matcher)},
-	}
-
-	logger := r.logger
-
-	listener, err := net.Listen(cfg.Network, cfg.Addr.String())
-	if err != nil {
-		logger.Error("Could not start listener", zap.Error(err))
-		return nil, errors.Wrapf(err, "failed to start listener: %v/%v", cfg.Addr.String(), cfg.Network)
+		logger:    zap.L().With(zap.String("addr", cfg.Addr.String()), zap.String("network", cfg.Network)),
+		name:      name,
+		key:       cfg,
+		metrics:   metrics,
+		enableTLS: enableTLS,
 	}
+	// An empty set of sites is always valid.
+	_ = r.setSitesLocked(nil)
 
 	handler := httplog.LoggerWithConfig(httplog.LoggerConfig{
 		Formatter: lzap.ZapLogger(r.logger, zap.InfoLevel, "HTTP Request"),
 	})(http.HandlerFunc(r.handler))
 
 	r.server = &http.Server{
-		Handler: handler,
+		Handler:           handler,
+		ReadHeaderTimeout: enabledTimeout(timeouts.ReadHeader),
+		ReadTimeout:       enabledTimeout(timeouts.Read),
+		WriteTimeout:      enabledTimeout(timeouts.Write),
+		IdleTimeout:       enabledTimeout(timeouts.Idle),
+		ConnState:         trackConnState(activeConnectionsGauge(name)),
 	}
 
+	if enableTLS {
+		r.server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: r.getCertificate,
+		}
+	}
+
+	return r
+}
+
+// start serves requests on inherited, or on the listener address if inherited
+// is nil, until ctx is cancelled or the listener is closed.
+func (l *HTTPEdgeListener) start(ctx context.Context, inherited net.Listener) error {
+	logger := l.logger
+
+	listener, err := listenOrInherit(logger, l.key, inherited)
+	if err != nil {
+		return err
+	}
+	l.listener = listener
+
 	go func() {
-		err := r.server.Serve(listener)
-		if !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if l.enableTLS {
+			// Certificates are supplied by TLSConfig.GetCertificate
+			err = l.server.ServeTLS(l.listener, "", "")
+		} else {
+			err = l.server.Serve(l.listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
 			logger.Error("Got error starting HTTP server", zap.Error(err))
 		} else {
 			logger.Info("Server closed")
@@ -135,13 +251,114 @@ func NewHTTPEdgeListener(ctx context.Context, cfg listenerKey) (Listener, error)
 	}()
 
 	go func() {
-		<-ctx.Done()
-		logger.Info("HTTP request server shutdown")
-		if err := r.server.Shutdown(context.Background()); err != nil {
-			logger.Error("Got error while closing HTTP server", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			_ = l.Close()
+		case <-l.listener.closed:
 		}
-		logger.Info("HTTP server shutdown successful")
 	}()
 
-	return r, nil
+	return nil
+}
+
+// socket implements managedListener.
+func (l *HTTPEdgeListener) socket() net.Listener {
+	if l.listener == nil {
+		return nil
+	}
+	return l.listener.Listener
+}
+
+// Close implements Listener. In-flight requests are finished before idle
+// connections are closed.
+func (l *HTTPEdgeListener) Close() error {
+	logger := l.logger
+	l.shutdown.Do(func() {
+		// The server drops requests which finish arriving after Shutdown is
+		// called, so stop accepting first and give connections which were just
+		// accepted time to send their request. Keep-alives are disabled so
+		// connections close once they are answered.
+		if l.listener != nil {
+			_ = l.listener.Close()
+		}
+		l.server.SetKeepAlivesEnabled(false)
+		go func() {
+			time.Sleep(httpListenerDrainDelay)
+			logger.Info("HTTP request server shutdown")
+			if err := l.server.Shutdown(context.Background()); err != nil {
+				logger.Error("Got error while closing HTTP server", zap.Error(err))
+			}
+			logger.Info("HTTP server shutdown successful")
+		}()
+	})
+	if l.listener != nil {
+		<-l.listener.closed
+	}
+	return nil
+}
+
+// trackConnState returns a http.Server ConnState hook which counts the open
+// connections in gauge. Hijacked connections are counted by the upgrade instead.
+func trackConnState(gauge prometheus.Gauge) func(net.Conn, http.ConnState) {
+	return func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			gauge.Inc()
+		case http.StateHijacked, http.StateClosed:
+			gauge.Dec()
+		default:
+		}
+	}
+}
+
+// listenOrInherit returns inherited ready to serve, or listens on the address of
+// key if inherited is nil.
+func listenOrInherit(logger *zap.Logger, key listenerKey, inherited net.Listener) (*closeNotifyListener, error) {
+	if inherited != nil {
+		return newCloseNotifyListener(inherited), nil
+	}
+	listener, err := net.Listen(key.Network, key.Addr.String())
+	if err != nil {
+		logger.Error("Could not start listener", zap.Error(err))
+		return nil, errors.Wrapf(err, "failed to start listener: %v/%v", key.Addr.String(), key.Network)
+	}
+	return newCloseNotifyListener(listener), nil
+}
+
+// duplicateListener returns a new listener on the socket of listener. The socket
+// stays open when listener is closed, so it can be handed over to a replacement
+// without refusing connections.
+func duplicateListener(listener net.Listener) (net.Listener, error) {
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.Wrapf(ErrListenerHandoverFailed, "unsupported listener %T", listener)
+	}
+	file, err := filer.File()
+	if err != nil {
+		return nil, errors.Wrapf(ErrListenerHandoverFailed, "%v", err)
+	}
+	defer file.Close()
+	duplicate, err := net.FileListener(file)
+	if err != nil {
+		return nil, errors.Wrapf(ErrListenerHandoverFailed, "%v", err)
+	}
+	return duplicate, nil
+}
+
+// closeNotifyListener signals when the listener has been closed.
+type closeNotifyListener struct {
+	net.Listener
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newCloseNotifyListener(listener net.Listener) *closeNotifyListener {
+	return &closeNotifyListener{Listener: listener, closed: make(chan struct{})}
+}
+
+// Close implements net.Listener.
+func (l *closeNotifyListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { close(l.closed) })
+	return err
 }
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"maps"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+const wildcardMatch = "*"
+
+// matcher encodes the trie structure used for resolving wildcard domains.
+type matcher[T any] struct {
+	value    T
+	found    bool
+	subtrees map[string]*matcher[T]
+}
+
+// newMatcher returns an empty matcher root.
+func newMatcher[T any]() *matcher[T] {
+	return &matcher[T]{subtrees: make(map[string]*matcher[T])}
+}
+
+// add inserts value for the given host pattern. It returns true if an existing
+// value was replaced.
+func (m *matcher[T]) add(host string, value T) bool {
+	hostComponents := lo.Reverse(strings.Split(host, "."))
+	currentMatcher := m
+	for _, domain := range hostComponents {
+		if nextMatcher, found := currentMatcher.subtrees[domain]; found {
+			currentMatcher = nextMatcher
+		} else {
+			currentMatcher.subtrees[domain] = newMatcher[T]()
+			currentMatcher = currentMatcher.subtrees[domain]
+		}
+	}
+
+	replaced := currentMatcher.found
+	currentMatcher.value = value
+	currentMatcher.found = true
+
+	return replaced
+}
+
+// without returns a copy of the trie with the value for the host pattern
+// removed, pruning subtrees which are left empty. Unchanged subtrees are shared
+// with m, which is not modified and so stays safe for concurrent lookups. Since
+// subtrees are shared neither trie may be changed with add afterwards.
+func (m *matcher[T]) without(host string) *matcher[T] {
+	if m == nil {
+		return nil
+	}
+	return m.withoutComponents(lo.Reverse(strings.Split(host, ".")))
+}
+
+func (m *matcher[T]) withoutComponents(hostComponents []string) *matcher[T] {
+	if len(hostComponents) == 0 {
+		var empty T
+		return &matcher[T]{value: empty, found: false, subtrees: m.subtrees}
+	}
+
+	nextMatcher, found := m.subtrees[hostComponents[0]]
+	if !found {
+		return m
+	}
+
+	pruned := nextMatcher.withoutComponents(hostComponents[1:])
+	clone := &matcher[T]{value: m.value, found: m.found, subtrees: maps.Clone(m.subtrees)}
+	if !pruned.found && len(pruned.subtrees) == 0 {
+		delete(clone.subtrees, hostComponents[0])
+	} else {
+		clone.subtrees[hostComponents[0]] = pruned
+	}
+	return clone
+}
+
+// match tries to find the most specific value for host in the trie.
+func (m *matcher[T]) match(host string) (T, bool) {
+	hostComponents := lo.Reverse(strings.Split(host, "."))
+	currentMatcher := m
+	wasWildCard := false
+	for _, domain := range hostComponents {
+		if nextMatcher, found := currentMatcher.subtrees[domain]; found {
+			currentMatcher = nextMatcher
+			wasWildCard = false
+			continue
+		}
+		// No match - but is there a wildcard?
+		if nextMatcher, found := currentMatcher.subtrees[wildcardMatch]; found {
+			currentMatcher = nextMatcher
+			wasWildCard = true
+			continue
+		}
+		// No match, but was the last match a wildcard?
+		if wasWildCard {
+			continue
+		}
+		// No match at all. Stop.
+		break
+	}
+
+	return currentMatcher.value, currentMatcher.found
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	metricsNamespace       = "proxyreverse"
+	defaultMetricsPath     = "/metrics"
+	metricsReadHeaderLimit = 10 * time.Second
+)
+
+// Target selection outcomes.
+const (
+	selectionSelected    = "selected"
+	selectionRetry       = "retry"
+	selectionNoTarget    = "no_target"
+	selectionCircuitOpen = "circuit_open"
+)
+
+// dynamicTargetLabel is the target label of targets which are not configured
+// on the backend, such as those chosen by the client's Host header or path.
+const dynamicTargetLabel = "dynamic"
+
+// Metrics which are not specific to a site. The extra labels of the metrics
+// configuration are added to these as constant labels when they are registered.
+//
+//nolint:gochecknoglobals
+var (
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_connections",
+		Help:      "Number of open client connections.",
+	}, []string{"listener"})
+	proxychainDialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "proxychain_dial_duration_seconds",
+		Help:      "Time taken to connect to destinations through the proxychain.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"proxychain"})
+	proxychainDialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "proxychain_dial_errors_total",
+		Help:      "Number of failed connections to destinations through the proxychain.",
+	}, []string{"proxychain"})
+	proxyHopDialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "proxy_hop_dial_duration_seconds",
+		Help:      "Time taken to connect to a proxy hop through the hops before it.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"proxychain", "hop"})
+	proxyHopDialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "proxy_hop_dial_errors_total",
+		Help:      "Number of failed connections to a proxy hop through the hops before it.",
+	}, []string{"proxychain", "hop"})
+	circuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of circuit breakers (0 closed, 1 open, 2 half-open).",
+	}, []string{"breaker"})
+)
+
+// serverMetrics are the metrics of sites. The extra labels of the metrics
+// configuration are variable labels so sites can override their values.
+type serverMetrics struct {
+	registry    *prometheus.Registry
+	labels      map[string]string // labels are the extra labels and their default values
+	extraLabels []string          // extraLabels are the sorted names of the extra labels
+
+	httpRequests     *prometheus.CounterVec
+	httpDuration     *prometheus.HistogramVec
+	receivedBytes    *prometheus.CounterVec
+	sentBytes        *prometheus.CounterVec
+	targetSelections *prometheus.CounterVec
+}
+
+// newServerMetrics initializes the metrics registry with the extra labels of cfg.
+func newServerMetrics(cfg config.MetricsConfig) (*serverMetrics, error) {
+	m := &serverMetrics{
+		registry:    prometheus.NewRegistry(),
+		labels:      maps.Clone(cfg.Labels),
+		extraLabels: slices.Sorted(maps.Keys(cfg.Labels)),
+	}
+
+	siteLabels := func(labels ...string) []string {
+		return append(labels, m.extraLabels...)
+	}
+	m.httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by response status code.",
+	}, siteLabels("listener", "site", "target", "code"))
+	m.httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, siteLabels("listener", "site", "target"))
+	m.receivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "received_bytes_total",
+		Help:      "Number of bytes received from clients.",
+	}, siteLabels("listener", "site"))
+	m.sentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sent_bytes_total",
+		Help:      "Number of bytes sent to clients.",
+	}, siteLabels("listener", "site"))
+	m.targetSelections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "target_selections_total",
+		Help:      "Number of backend target selections by outcome.",
+	}, siteLabels("listener", "site", "target", "outcome"))
+
+	constRegisterer := prometheus.WrapRegistererWith(cfg.Labels, m.registry)
+	for _, collector := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		activeConnections,
+		proxychainDialDuration,
+		proxychainDialErrors,
+		proxyHopDialDuration,
+		proxyHopDialErrors,
+		circuitBreakerState,
+	} {
+		if err := constRegisterer.Register(collector); err != nil {
+			return nil, errors.Wrap(err, "failed to register metrics")
+		}
+	}
+	for _, collector := range []prometheus.Collector{
+		m.httpRequests, m.httpDuration, m.receivedBytes, m.sentBytes, m.targetSelections,
+	} {
+		if err := m.registry.Register(collector); err != nil {
+			return nil, errors.Wrap(err, "failed to register metrics")
+		}
+	}
+	return m, nil
+}
+
+// checkLabels returns an error if cfg changes the extra labels, which can only
+// be set at startup.
+func (m *serverMetrics) checkLabels(cfg config.MetricsConfig) error {
+	if m == nil || maps.Equal(m.labels, cfg.Labels) {
+		return nil
+	}
+	return errors.Wrap(config.ErrInconsistentLabels, "extra metrics labels can't be changed by a reload")
+}
+
+// siteLabels returns the values of the extra labels for site.
+func (m *serverMetrics) siteLabels(site config.SiteConfig) []string {
+	if m == nil {
+		return nil
+	}
+	values := make([]string, 0, len(m.extraLabels))
+	for _, name := range m.extraLabels {
+		value, found := site.MetricsLabels[name]
+		if !found {
+			value = m.labels[name]
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// addBytes records the bytes transferred for a site.
+func (m *serverMetrics) addBytes(listener string, site *Site, bytesIn, bytesOut int64) {
+	if m == nil {
+		return
+	}
+	labels := append([]string{listener, site.Host}, site.MetricsLabels...)
+	m.receivedBytes.WithLabelValues(labels...).Add(float64(bytesIn))
+	m.sentBytes.WithLabelValues(labels...).Add(float64(bytesOut))
+}
+
+// serveHTTP serves request with the site handler and records the request metrics.
+func (m *serverMetrics) serveHTTP(listener string, site *Site, writer http.ResponseWriter, request *http.Request) {
+	if m == nil {
+		site.Handler.ServeHTTP(writer, request)
+		return
+	}
+
+	startTime := time.Now()
+	rm := &requestMetrics{metrics: m, listener: listener, site: site}
+	body := &countingReadCloser{ReadCloser: request.Body}
+	request.Body = body
+	metricsWriter := &metricsResponseWriter{ResponseWriter: writer}
+
+	site.Handler.ServeHTTP(metricsWriter, request.WithContext(context.WithValue(request.Context(),
+		requestMetricsKey{}, rm)))
+
+	status := metricsWriter.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	labels := append([]string{listener, site.Host, rm.target}, site.MetricsLabels...)
+	m.httpDuration.WithLabelValues(labels...).Observe(time.Since(startTime).Seconds())
+	labels = append([]string{listener, site.Host, rm.target, strconv.Itoa(status)}, site.MetricsLabels...)
+	m.httpRequests.WithLabelValues(labels...).Inc()
+	m.addBytes(listener, site, body.count.Load()+rm.upgradeBytesIn, metricsWriter.count+rm.upgradeBytesOut)
+}
+
+// handler returns the HTTP handler which serves the metrics.
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// startMetrics serves the metrics if an address is configured, until ctx is cancelled.
+func startMetrics(ctx context.Context, cfg config.MetricsConfig, m *serverMetrics) error {
+	if cfg.ListenAddr.Port == 0 {
+		return nil
+	}
+	logger := zap.L().With(zap.String("component", "metrics"))
+
+	path := cfg.Path
+	if path == "" {
+		path = defaultMetricsPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET "+path, m.handler())
+
+	listener, err := net.Listen(cfg.ListenAddr.Network, cfg.ListenAddr.HostPort())
+	if err != nil {
+		return errors.Wrapf(err, "failed to start metrics listener: %v", cfg.ListenAddr.String())
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: metricsReadHeaderLimit,
+	}
+
+	logger.Info("Metrics listening", zap.String("addr", listener.Addr().String()), zap.String("path", path))
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Got error starting metrics server", zap.Error(err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			logger.Error("Got error while closing metrics server", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+type requestMetricsKey struct{}
+
+// requestMetrics collects the metrics of a request as it is served by a backend.
+type requestMetrics struct {
+	metrics  *serverMetrics
+	listener string
+	site     *Site
+	target   string
+
+	// Upgraded connections are spliced after the response writer is hijacked.
+	upgradeBytesIn  int64
+	upgradeBytesOut int64
+}
+
+// requestMetricsFrom returns the request metrics of ctx, or nil if the request
+// is not being measured. All methods are safe to call on a nil requestMetrics.
+func requestMetricsFrom(ctx context.Context) *requestMetrics {
+	rm, _ := ctx.Value(requestMetricsKey{}).(*requestMetrics)
+	return rm
+}
+
+// selection records the outcome of selecting target.
+func (r *requestMetrics) selection(target string, outcome string) {
+	if r == nil {
+		return
+	}
+	r.target = target
+	labels := append([]string{r.listener, r.site.Host, target, outcome}, r.site.MetricsLabels...)
+	r.metrics.targetSelections.WithLabelValues(labels...).Inc()
+}
+
+// upgradeOpened counts the upgraded connection as an open connection, since it
+// is no longer tracked by the HTTP server once it is hijacked.
+func (r *requestMetrics) upgradeOpened() {
+	if r == nil {
+		return
+	}
+	activeConnectionsGauge(r.listener).Inc()
+}
+
+// upgradeClosed records the bytes transferred over the upgraded connection.
+func (r *requestMetrics) upgradeClosed(bytesIn, bytesOut int64) {
+	if r == nil {
+		return
+	}
+	activeConnectionsGauge(r.listener).Dec()
+	r.upgradeBytesIn += bytesIn
+	r.upgradeBytesOut += bytesOut
+}
+
+// countingReadCloser counts the bytes read from a request body. The body may be
+// read by the transport in another goroutine.
+type countingReadCloser struct {
+	io.ReadCloser
+	count atomic.Int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count.Add(int64(n))
+	return n, err //nolint:wrapcheck
+}
+
+// metricsResponseWriter records the status code and size of a response. Other
+// response writer features are reached through http.ResponseController.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	count  int64
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *metricsResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 && statusCode >= http.StatusOK {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements http.ResponseWriter.
+func (w *metricsResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.count += int64(n)
+	return n, err //nolint:wrapcheck
+}
+
+// Hijack implements http.Hijacker. Hijacked connections are upgrades, so they
+// are recorded as switching protocols.
+func (w *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err //nolint:wrapcheck
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrumentedProxychain records the dials through a proxychain.
+type instrumentedProxychain struct {
+	name  string
+	chain Proxychain
+}
+
+// Dialer implements Proxychain.
+func (p *instrumentedProxychain) Dialer() proxy.ContextDialer {
+	return p
+}
+
+// DialContext implements proxy.ContextDialer.
+func (p *instrumentedProxychain) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	startTime := time.Now()
+	conn, err := p.chain.Dialer().DialContext(ctx, network, addr)
+	if err != nil {
+		proxychainDialErrors.WithLabelValues(p.name).Inc()
+		return nil, err //nolint:wrapcheck
+	}
+	proxychainDialDuration.WithLabelValues(p.name).Observe(time.Since(startTime).Seconds())
+	return conn, nil
+}
+
+// hopDialError marks dial errors which have been recorded against a hop, so
+// that the hops after it do not record them again.
+type hopDialError struct {
+	err error
+}
+
+func (e *hopDialError) Error() string { return e.err.Error() }
+func (e *hopDialError) Unwrap() error { return e.err }
+func (e *hopDialError) Cause() error  { return e.err }
+
+// Timeout implements net.Error.
+func (e *hopDialError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.err, &netErr) && netErr.Timeout()
+}
+
+// Temporary implements net.Error.
+func (e *hopDialError) Temporary() bool {
+	var netErr net.Error
+	//nolint:staticcheck
+	return errors.As(e.err, &netErr) && netErr.Temporary()
+}
+
+// hopMetricsDialer records the dials to a proxy hop made by the dialer of the
+// hops before it.
+type hopMetricsDialer struct {
+	forward    proxy.Dialer
+	proxychain string
+	hop        string
+}
+
+// Dial implements proxy.Dialer.
+func (d *hopMetricsDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer.
+func (d *hopMetricsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	startTime := time.Now()
+	conn, err := dialForward(ctx, d.forward, network, addr)
+	if err != nil {
+		var hopErr *hopDialError
+		if errors.As(err, &hopErr) {
+			return nil, err
+		}
+		proxyHopDialErrors.WithLabelValues(d.proxychain, d.hop).Inc()
+		return nil, &hopDialError{err: err}
+	}
+	proxyHopDialDuration.WithLabelValues(d.proxychain, d.hop).Observe(time.Since(startTime).Seconds())
+	return conn, nil
+}
+
+// activeConnectionsGauge returns the open connections gauge of a listener.
+func activeConnectionsGauge(listener string) prometheus.Gauge {
+	return activeConnections.WithLabelValues(listener)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+func TestMetricsTargetLabelBounded(t *testing.T) {
+	target := newTestBackend(t, "ok")
+	chain, err := NewProxychainFromConfig("test", config.ProxychainConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := newServerMetrics(config.MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newSite := func(host string, backendCfg config.BackendConfig) *Site {
+		backend, err := NewHTTPBackend(ctx, backendCfg, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Site{Host: host, Handler: backend}
+	}
+	configured := newSite("configured.example", config.BackendConfig{Target: target})
+	// Without a configured target the client's Host header chooses it.
+	dynamic := newSite("dynamic.example", config.BackendConfig{Target: config.HostSpec{Port: target.Port}})
+
+	for _, host := range []string{"127.0.0.1", "localhost", "127.0.0.1"} {
+		for _, site := range []*Site{configured, dynamic} {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Host = host
+			recorder := httptest.NewRecorder()
+			metrics.serveHTTP("web", site, recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("%s via %s: unexpected status %v", site.Host, host, recorder.Code)
+			}
+		}
+	}
+
+	if count := testutil.CollectAndCount(metrics.httpRequests); count != 2 {
+		t.Errorf("expected one series per site, got %d", count)
+	}
+	for site, label := range map[string]string{
+		"configured.example": target.HostPort(),
+		"dynamic.example":    dynamicTargetLabel,
+	} {
+		requests := metrics.httpRequests.WithLabelValues("web", site, label, "200")
+		if value := testutil.ToFloat64(requests); value != 3 {
+			t.Errorf("%s: expected 3 requests with target %q, got %v", site, label, value)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultPACCacheTTL = 5 * time.Minute
+	pacFetchTimeout    = 30 * time.Second
+	pacEvaluateTimeout = 5 * time.Second
+	pacDNSTimeout      = 5 * time.Second
+	pacMaxSize         = 1 << 20
+	pacCacheMaxEntries = 1024
+)
+
+var (
+	ErrPACSourceNeeded      = errors.New("pac hop requires a pac source")
+	ErrPACFetchFailed       = errors.New("could not fetch PAC file")
+	ErrPACNoFindProxyForURL = errors.New("PAC file does not define FindProxyForURL")
+	ErrPACEvaluateTimeout   = errors.New("FindProxyForURL timed out")
+	ErrPACNoUsableProxy     = errors.New("PAC file returned no usable proxy")
+)
+
+// pacUtils implements the standard PAC helper functions which are not
+// implemented natively.
+const pacUtils = `
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length && host.substring(host.length - domain.length) == domain;
+}
+function dnsDomainLevels(host) { return host.split('.').length - 1; }
+function isPlainHostName(host) { return host.indexOf('.') == -1; }
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+function isResolvable(host) { return dnsResolve(host) !== null; }
+function isInNet(host, pattern, mask) {
+	var ip = /^\d+\.\d+\.\d+\.\d+$/.test(host) ? host : dnsResolve(host);
+	return ip !== null && __isInNet(ip, pattern, mask);
+}
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&').replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+function __now(args) {
+	var d = new Date();
+	var gmt = args.length > 0 && args[args.length - 1] == 'GMT';
+	return { gmt: gmt, args: gmt ? Array.prototype.slice.call(args, 0, -1) : Array.prototype.slice.call(args),
+		day: gmt ? d.getUTCDay() : d.getDay(), date: gmt ? d.getUTCDate() : d.getDate(),
+		month: gmt ? d.getUTCMonth() : d.getMonth(), year: gmt ? d.getUTCFullYear() : d.getFullYear(),
+		seconds: gmt ? d.getUTCHours() * 3600 + d.getUTCMinutes() * 60 + d.getUTCSeconds()
+			: d.getHours() * 3600 + d.getMinutes() * 60 + d.getSeconds() };
+}
+function __inRange(value, start, end) {
+	return start <= end ? value >= start && value <= end : value >= start || value <= end;
+}
+function weekdayRange() {
+	var days = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+	var now = __now(arguments);
+	var start = days.indexOf(now.args[0]);
+	var end = now.args.length > 1 ? days.indexOf(now.args[1]) : start;
+	return start >= 0 && end >= 0 && __inRange(now.day, start, end);
+}
+function timeRange() {
+	var now = __now(arguments);
+	var a = now.args;
+	switch (a.length) {
+	case 1: return Math.floor(now.seconds / 3600) == a[0];
+	case 2: return __inRange(now.seconds, a[0] * 3600, a[1] * 3600 + 3599);
+	case 4: return __inRange(now.seconds, a[0] * 3600 + a[1] * 60, a[2] * 3600 + a[3] * 60 + 59);
+	case 6: return __inRange(now.seconds, a[0] * 3600 + a[1] * 60 + a[2], a[3] * 3600 + a[4] * 60 + a[5]);
+	}
+	return false;
+}
+function dateRange() {
+	var months = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+	var now = __now(arguments);
+	var parse = function(args) {
+		var r = {};
+		for (var i = 0; i < args.length; i++) {
+			var m = months.indexOf(args[i]);
+			if (m >= 0) { r.month = m; } else if (args[i] > 31) { r.year = args[i]; } else { r.date = args[i]; }
+		}
+		return r;
+	};
+	var value = function(r, like) {
+		return ('year' in like ? now.year : 0) * 10000 + ('month' in like ? now.month : 0) * 100 + ('date' in like ? now.date : 0);
+	};
+	var bound = function(r) {
+		return (r.year || 0) * 10000 + (r.month || 0) * 100 + (r.date || 0);
+	};
+	var a = now.args;
+	if (a.length == 1) {
+		var single = parse(a);
+		return value(single, single) == bound(single);
+	}
+	var start = parse(a.slice(0, a.length / 2));
+	var end = parse(a.slice(a.length / 2));
+	return __inRange(value(start, start), bound(start), bound(end));
+}
+function alert(message) {}
+`
+
+//nolint:gochecknoglobals
+var pacUtilsProgram = goja.MustCompile("pac_utils.js", pacUtils, false)
+
+// pacDirective is a single entry of a FindProxyForURL result.
+type pacDirective struct {
+	direct   bool
+	proxyURL *url.URL
+}
+
+// pacCacheKey identifies the arguments of a FindProxyForURL call.
+type pacCacheKey struct {
+	url  string
+	host string
+}
+
+// pacResult is a cached FindProxyForURL result.
+type pacResult struct {
+	key        pacCacheKey
+	directives []pacDirective
+	expires    time.Time
+}
+
+// pacDialer dials through the proxies chosen by a proxy auto-config file. The
+// chosen proxies are reached with the forward dialer.
+type pacDialer struct {
+	logger   *zap.Logger
+	forward  proxy.Dialer
+	cacheTTL time.Duration
+
+	// Each evaluation takes a VM of its own from the pool, since runtimes
+	// can't be shared between goroutines and DNS lookups in the PAC file may
+	// block for a while.
+	program         *goja.Program
+	vms             sync.Pool
+	evaluateTimeout time.Duration
+
+	// The cache is an LRU of results by the FindProxyForURL arguments, most
+	// recently used first.
+	cacheMu    sync.Mutex
+	cache      map[pacCacheKey]*list.Element
+	cacheOrder *list.List
+	cacheSize  int
+
+	dialersMu sync.Mutex
+	dialers   map[string]proxy.Dialer
+}
+
+// loadPAC reads a PAC file from disk, or fetches it directly if source is an
+// http(s) URL.
+func loadPAC(source string) (string, error) {
+	sourceURL, err := url.Parse(source)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		path := strings.TrimPrefix(source, "file://")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not read PAC file: %s", path)
+		}
+		return string(data), nil
+	}
+
+	// The PAC file is never fetched through a proxy.
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: nil},
+		Timeout:   pacFetchTimeout,
+	}
+	resp, err := client.Get(source)
+	if err != nil {
+		return "", errors.Wrapf(ErrPACFetchFailed, "%s: %v", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Wrapf(ErrPACFetchFailed, "%s: %s", source, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, pacMaxSize))
+	if err != nil {
+		return "", errors.Wrapf(ErrPACFetchFailed, "%s: %v", source, err)
+	}
+	return string(data), nil
+}
+
+// newPACDialer loads the PAC file and prepares it for evaluation.
+func newPACDialer(cfg config.PACConfig, forward proxy.Dialer) (*pacDialer, error) {
+	if cfg.Source == "" {
+		return nil, ErrPACSourceNeeded
+	}
+
+	script, err := loadPAC(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := goja.Compile(cfg.Source, script, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse PAC file: %s", cfg.Source)
+	}
+
+	d := &pacDialer{
+		logger:   zap.L().With(zap.String("pac_source", cfg.Source)),
+		forward:  forward,
+		cacheTTL: cfg.CacheTTL,
+		program:  program,
+		cache:    make(map[pacCacheKey]*list.Element),
+		dialers:  make(map[string]proxy.Dialer),
+
+		cacheOrder:      list.New(),
+		cacheSize:       pacCacheMaxEntries,
+		evaluateTimeout: pacEvaluateTimeout,
+	}
+	if d.cacheTTL == 0 {
+		d.cacheTTL = defaultPACCacheTTL
+	}
+
+	// Check the PAC file loads, and keep the VM for the first evaluation.
+	vm, err := d.newVM()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", cfg.Source)
+	}
+	d.vms.Put(vm)
+
+	return d, nil
+}
+
+// pacVM is a runtime with the PAC file loaded.
+type pacVM struct {
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+// newVM returns a new runtime with the PAC file loaded.
+func (d *pacDialer) newVM() (*pacVM, error) {
+	vm := goja.New()
+	if err := vm.Set("dnsResolve", pacDNSResolve(vm)); err != nil {
+		return nil, errors.Wrap(err, "newVM")
+	}
+	if err := vm.Set("myIpAddress", pacMyIPAddress); err != nil {
+		return nil, errors.Wrap(err, "newVM")
+	}
+	if err := vm.Set("__isInNet", pacIsInNet); err != nil {
+		return nil, errors.Wrap(err, "newVM")
+	}
+	if _, err := vm.RunProgram(pacUtilsProgram); err != nil {
+		return nil, errors.Wrap(err, "BUG: PAC utility functions failed to load")
+	}
+	if _, err := vm.RunProgram(d.program); err != nil {
+		return nil, errors.Wrap(err, "could not evaluate PAC file")
+	}
+
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, ErrPACNoFindProxyForURL
+	}
+	return &pacVM{vm: vm, find: find}, nil
+}
+
+// pacDNSResolve implements dnsResolve, returning null if host does not resolve.
+func pacDNSResolve(vm *goja.Runtime) func(host string) goja.Value {
+	return func(host string) goja.Value {
+		ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+		if err != nil || len(addrs) == 0 {
+			return goja.Null()
+		}
+		return vm.ToValue(addrs[0].Unmap().String())
+	}
+}
+
+// pacMyIPAddress implements myIpAddress using the address of the default route.
+func pacMyIPAddress() string {
+	conn, err := net.Dial("udp4", "198.51.100.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+// pacIsInNet returns true if ip is in the network given by pattern and mask.
+func pacIsInNet(ip string, pattern string, mask string) bool {
+	parsedIP := net.ParseIP(ip).To4()
+	parsedPattern := net.ParseIP(pattern).To4()
+	parsedMask := net.ParseIP(mask).To4()
+	if parsedIP == nil || parsedPattern == nil || parsedMask == nil {
+		return false
+	}
+	return parsedIP.Mask(net.IPMask(parsedMask)).Equal(parsedPattern.Mask(net.IPMask(parsedMask)))
+}
+
+// pacURL returns the URL passed to FindProxyForURL for a connection to host and port.
+func pacURL(host string, port string) string {
+	switch port {
+	case "443":
+		return "https://" + host + "/"
+	case "80":
+		return "http://" + host + "/"
+	default:
+		return "http://" + net.JoinHostPort(host, port) + "/"
+	}
+}
+
+// parsePACResult parses a FindProxyForURL result into directives. Unsupported
+// directives are skipped.
+func parsePACResult(result string) []pacDirective {
+	var directives []pacDirective
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			directives = append(directives, pacDirective{direct: true})
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+
+		var scheme string
+		switch kind {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		directives = append(directives, pacDirective{proxyURL: &url.URL{Scheme: scheme, Host: fields[1]}})
+	}
+	return directives
+}
+
+// evaluate runs FindProxyForURL for addr.
+func (d *pacDialer) evaluate(addr string) ([]pacDirective, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "pac")
+	}
+
+	vm, ok := d.vms.Get().(*pacVM)
+	if !ok {
+		if vm, err = d.newVM(); err != nil {
+			return nil, err
+		}
+	}
+
+	timer := time.AfterFunc(d.evaluateTimeout, func() { vm.vm.Interrupt(ErrPACEvaluateTimeout) })
+	result, err := vm.find(goja.Undefined(), vm.vm.ToValue(pacURL(host, port)), vm.vm.ToValue(host))
+	if timer.Stop() {
+		// The interrupt was never requested, so the VM can be reused.
+		d.vms.Put(vm)
+	}
+	// Otherwise the interrupt may land after the call returned, so the VM is
+	// dropped rather than poisoning a later evaluation.
+	if err != nil {
+		return nil, errors.Wrapf(err, "FindProxyForURL failed for %s", addr)
+	}
+
+	directives := parsePACResult(result.String())
+	d.logger.Debug("Evaluated PAC file", zap.String("target_addr", addr), zap.String("result", result.String()))
+	if len(directives) == 0 {
+		return nil, errors.Wrapf(ErrPACNoUsableProxy, "%s: %q", addr, result.String())
+	}
+	return directives, nil
+}
+
+// directives returns the cached directives for addr, evaluating the PAC file if
+// needed. Results are cached by the URL and host passed to FindProxyForURL, since
+// the URL scheme and port may change the result.
+func (d *pacDialer) directives(addr string) ([]pacDirective, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "pac")
+	}
+	key := pacCacheKey{url: pacURL(host, port), host: host}
+	now := time.Now()
+
+	d.cacheMu.Lock()
+	if elem, found := d.cache[key]; found {
+		cached, _ := elem.Value.(*pacResult)
+		if now.Before(cached.expires) {
+			d.cacheOrder.MoveToFront(elem)
+			d.cacheMu.Unlock()
+			return cached.directives, nil
+		}
+	}
+	d.cacheMu.Unlock()
+
+	directives, err := d.evaluate(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+	result := &pacResult{key: key, directives: directives, expires: now.Add(d.cacheTTL)}
+	if elem, found := d.cache[key]; found {
+		elem.Value = result
+		d.cacheOrder.MoveToFront(elem)
+		return directives, nil
+	}
+	// Evict the least recently used result to bound the cache.
+	for d.cacheOrder.Len() >= d.cacheSize {
+		oldest := d.cacheOrder.Back()
+		oldestResult, _ := oldest.Value.(*pacResult)
+		delete(d.cache, oldestResult.key)
+		d.cacheOrder.Remove(oldest)
+	}
+	d.cache[key] = d.cacheOrder.PushFront(result)
+	return directives, nil
+}
+
+// dialerFor returns the dialer for a directive.
+func (d *pacDialer) dialerFor(directive pacDirective) (proxy.Dialer, error) {
+	if directive.direct {
+		return d.forward, nil
+	}
+
+	key := directive.proxyURL.String()
+	d.dialersMu.Lock()
+	defer d.dialersMu.Unlock()
+	if dialer, found := d.dialers[key]; found {
+		return dialer, nil
+	}
+	dialer, err := proxyFromURL(directive.proxyURL, d.forward)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pac: unusable proxy %s", key)
+	}
+	d.dialers[key] = dialer
+	return dialer, nil
+}
+
+// Dial implements proxy.Dialer.
+func (d *pacDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer. The directives returned by the
+// PAC file are tried in order.
+func (d *pacDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	directives, err := d.directives(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for idx, directive := range directives {
+		dialer, err := d.dialerFor(directive)
+		if err == nil {
+			var conn net.Conn
+			if conn, err = dialForward(ctx, dialer, network, addr); err == nil {
+				return conn, nil
+			}
+		}
+		d.logger.Debug("PAC directive failed", zap.Int("directive", idx), zap.String("target_addr", addr),
+			zap.Error(err))
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Wrapf(lastErr, "pac: all proxies failed for %s (%d tried)", addr, len(directives))
+}
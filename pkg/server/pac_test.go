@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"golang.org/x/net/proxy"
+)
+
+// newTestPACDialer returns a dialer for a PAC file containing script.
+func newTestPACDialer(t *testing.T, script string) *pacDialer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newPACDialer(config.PACConfig{Source: path}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+const pacTestScript = `
+function FindProxyForURL(url, host) {
+	if (host == "loop") { while (true) {} }
+	if (host == "slow") {
+		var end = Date.now() + 500;
+		while (Date.now() < end) {}
+	}
+	return "DIRECT";
+}
+`
+
+func TestPACEvaluateTimeout(t *testing.T) {
+	d := newTestPACDialer(t, pacTestScript)
+	d.evaluateTimeout = 50 * time.Millisecond
+
+	if _, err := d.evaluate("loop:80"); !errors.Is(err, ErrPACEvaluateTimeout) {
+		t.Fatalf("expected ErrPACEvaluateTimeout, got %v", err)
+	}
+
+	// The interrupted VM must not affect the evaluations after it.
+	for range 10 {
+		if _, err := d.evaluate("example.com:80"); err != nil {
+			t.Fatalf("expected evaluation after a timeout to succeed: %v", err)
+		}
+	}
+}
+
+func TestPACEvaluateConcurrently(t *testing.T) {
+	d := newTestPACDialer(t, pacTestScript)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := d.evaluate("slow:80"); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer wg.Wait()
+
+	// Let the slow evaluation start first.
+	time.Sleep(50 * time.Millisecond)
+	startTime := time.Now()
+	if _, err := d.evaluate("example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 250*time.Millisecond {
+		t.Errorf("expected evaluation not to wait for a slow one, took %v", elapsed)
+	}
+}
+
+func TestPACCacheBounded(t *testing.T) {
+	d := newTestPACDialer(t, pacTestScript)
+	d.cacheSize = 4
+
+	for range 3 {
+		if _, err := d.directives("example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.cacheOrder.Len() != 1 {
+		t.Errorf("expected repeated destinations to share a result, got %d entries", d.cacheOrder.Len())
+	}
+
+	for idx := range 10 {
+		if _, err := d.directives(fmt.Sprintf("host%d.example:80", idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.cacheOrder.Len() != d.cacheSize || len(d.cache) != d.cacheSize {
+		t.Errorf("expected the cache to hold %d entries, got %d", d.cacheSize, d.cacheOrder.Len())
+	}
+	if _, found := d.cache[pacCacheKey{url: "http://host9.example/", host: "host9.example"}]; !found {
+		t.Error("expected the most recent destination to be cached")
+	}
+	if _, found := d.cache[pacCacheKey{url: "http://example.com/", host: "example.com"}]; found {
+		t.Error("expected the least recently used destination to be evicted")
+	}
+}
+
+func TestPACCacheKeepsSchemes(t *testing.T) {
+	d := newTestPACDialer(t, `
+function FindProxyForURL(url, host) {
+	if (url.substring(0, 5) == "https") { return "PROXY secure.proxy:3128"; }
+	return "PROXY plain.proxy:3128";
+}
+`)
+
+	// Evaluate each destination twice so the second answer comes from the cache.
+	for range 2 {
+		for addr, expected := range map[string]string{
+			"example.com:443":  "secure.proxy:3128",
+			"example.com:80":   "plain.proxy:3128",
+			"example.com:8080": "plain.proxy:3128",
+		} {
+			directives, err := d.directives(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(directives) != 1 || directives[0].proxyURL.Host != expected {
+				t.Errorf("%s: expected proxy %s, got %+v", addr, expected, directives)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/go-ntlmssp"
+	krb5client "github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+const defaultKrb5Config = "/etc/krb5.conf"
+
+var (
+	ErrUnknownProxyAuthMethod = errors.New("unknown proxy authentication method")
+	ErrProxyAuthNeedsUser     = errors.New("proxy authentication method requires credentials")
+	ErrProxyAuthNoChallenge   = errors.New("proxy did not send an authentication challenge")
+	ErrProxyAuthNoRealm       = errors.New("kerberos realm is not configured")
+)
+
+// proxyAuthenticator produces the Proxy-Authorization headers for an HTTP
+// CONNECT handshake. Connection based schemes such as NTLM take several rounds
+// on the same connection.
+type proxyAuthenticator interface {
+	// initial returns the header value sent with the first request.
+	initial() (string, error)
+	// respond returns the header value answering the Proxy-Authenticate
+	// challenges of a 407 response.
+	respond(challenges []string) (string, error)
+}
+
+// newProxyAuthenticator returns the authenticator configured for a proxy, or nil
+// if the proxy is not authenticated to.
+func newProxyAuthenticator(cfg config.ProxyAuth, proxyURL *url.URL) (proxyAuthenticator, error) {
+	user := proxyURL.User
+	method := cfg.Method
+	if method == "" {
+		if user == nil {
+			return nil, nil
+		}
+		method = config.ProxyAuthBasic
+	}
+
+	switch method {
+	case config.ProxyAuthBasic:
+		if user == nil {
+			return nil, errors.Wrapf(ErrProxyAuthNeedsUser, "%v", method)
+		}
+		return basicAuthenticator{user: user}, nil
+	case config.ProxyAuthNTLM:
+		return newNTLMAuthenticator("NTLM", cfg, user)
+	case config.ProxyAuthNegotiate:
+		if cfg.Kerberos.Keytab != "" {
+			return newKerberosAuthenticator(cfg.Kerberos, user, proxyURL.Hostname())
+		}
+		// Without Kerberos, NTLM is offered through the Negotiate scheme.
+		return newNTLMAuthenticator("Negotiate", cfg, user)
+	default:
+		return nil, errors.Wrapf(ErrUnknownProxyAuthMethod, "%v", method)
+	}
+}
+
+// findChallenge returns the decoded data of the challenge for scheme.
+func findChallenge(scheme string, challenges []string) ([]byte, error) {
+	for _, challenge := range challenges {
+		name, data, _ := strings.Cut(challenge, " ")
+		if !strings.EqualFold(name, scheme) || data == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s challenge", scheme)
+		}
+		return decoded, nil
+	}
+	return nil, errors.Wrapf(ErrProxyAuthNoChallenge, "%s: %s", scheme, strings.Join(challenges, ", "))
+}
+
+// basicAuthenticator implements Basic authentication. Credentials are sent with
+// the first request, so a challenge means they were rejected.
+type basicAuthenticator struct {
+	user *url.Userinfo
+}
+
+func (a basicAuthenticator) initial() (string, error) {
+	password, _ := a.user.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.user.Username()+":"+password)), nil
+}
+
+func (a basicAuthenticator) respond(challenges []string) (string, error) {
+	return "", errors.Wrapf(ErrProxyAuthRequired, "credentials rejected: %s", strings.Join(challenges, ", "))
+}
+
+// ntlmAuthenticator implements NTLMv2 authentication with the NTLM or
+// Negotiate scheme.
+type ntlmAuthenticator struct {
+	scheme       string
+	username     string
+	password     string
+	domain       string
+	domainNeeded bool
+	workstation  string
+}
+
+func newNTLMAuthenticator(scheme string, cfg config.ProxyAuth, user *url.Userinfo) (*ntlmAuthenticator, error) {
+	if user == nil {
+		return nil, errors.Wrapf(ErrProxyAuthNeedsUser, "%v", cfg.Method)
+	}
+	password, _ := user.Password()
+	username, domain, domainNeeded := ntlmssp.GetDomain(user.Username())
+	if cfg.Domain != "" {
+		domain, domainNeeded = cfg.Domain, true
+	}
+	return &ntlmAuthenticator{
+		scheme:       scheme,
+		username:     username,
+		password:     password,
+		domain:       domain,
+		domainNeeded: domainNeeded,
+		workstation:  cfg.Workstation,
+	}, nil
+}
+
+func (a *ntlmAuthenticator) initial() (string, error) {
+	negotiate, err := ntlmssp.NewNegotiateMessage(a.domain, a.workstation)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create NTLM negotiate message")
+	}
+	return a.scheme + " " + base64.StdEncoding.EncodeToString(negotiate), nil
+}
+
+func (a *ntlmAuthenticator) respond(challenges []string) (string, error) {
+	challenge, err := findChallenge(a.scheme, challenges)
+	if err != nil {
+		return "", err
+	}
+	authenticate, err := ntlmssp.ProcessChallenge(challenge, a.username, a.password, a.domainNeeded)
+	if err != nil {
+		return "", errors.Wrap(err, "could not answer NTLM challenge")
+	}
+	return a.scheme + " " + base64.StdEncoding.EncodeToString(authenticate), nil
+}
+
+// kerberosAuthenticator implements SPNEGO authentication with Kerberos tickets
+// obtained from a keytab.
+type kerberosAuthenticator struct {
+	client *krb5client.Client
+	spn    string
+}
+
+func newKerberosAuthenticator(cfg config.KerberosAuth, user *url.Userinfo, proxyHost string) (*kerberosAuthenticator, error) {
+	if user == nil {
+		return nil, errors.Wrapf(ErrProxyAuthNeedsUser, "%v", config.ProxyAuthNegotiate)
+	}
+
+	kt, err := keytab.Load(cfg.Keytab)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load keytab: %s", cfg.Keytab)
+	}
+
+	krb5ConfPath := cfg.Config
+	if krb5ConfPath == "" {
+		krb5ConfPath = defaultKrb5Config
+	}
+	krb5Conf, err := krb5config.Load(krb5ConfPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load kerberos config: %s", krb5ConfPath)
+	}
+
+	realm := cfg.Realm
+	if realm == "" {
+		realm = krb5Conf.LibDefaults.DefaultRealm
+	}
+	if realm == "" {
+		return nil, ErrProxyAuthNoRealm
+	}
+
+	spn := cfg.SPN
+	if spn == "" {
+		spn = "HTTP/" + proxyHost
+	}
+
+	return &kerberosAuthenticator{
+		client: krb5client.NewWithKeytab(user.Username(), realm, kt, krb5Conf, krb5client.DisablePAFXFAST(true)),
+		spn:    spn,
+	}, nil
+}
+
+func (a *kerberosAuthenticator) initial() (string, error) {
+	client := spnego.SPNEGOClient(a.client, a.spn)
+	if err := client.AcquireCred(); err != nil {
+		return "", errors.Wrap(err, "could not acquire kerberos credentials")
+	}
+	token, err := client.InitSecContext()
+	if err != nil {
+		return "", errors.Wrapf(err, "could not get kerberos service ticket for %s", a.spn)
+	}
+	data, err := token.Marshal()
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal SPNEGO token")
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (a *kerberosAuthenticator) respond(challenges []string) (string, error) {
+	return "", errors.Wrapf(ErrProxyAuthRequired, "kerberos ticket rejected: %s", strings.Join(challenges, ", "))
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+const (
+	ntlmNegotiateType    = 1
+	ntlmAuthenticateType = 3
+)
+
+// ntlmChallengeMessage returns a minimal NTLMv2 challenge message.
+func ntlmChallengeMessage() []byte {
+	const (
+		negotiateUnicode = 0x00000001
+		negotiateNTLM    = 0x00000200
+	)
+	var buf bytes.Buffer
+	buf.WriteString("NTLMSSP\x00")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(2)) // message type
+	buf.Write(make([]byte, 8))                             // target name
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(negotiateUnicode|negotiateNTLM))
+	buf.WriteString("\x01\x02\x03\x04\x05\x06\x07\x08") // server challenge
+	buf.Write(make([]byte, 8))                          // reserved
+	buf.Write(make([]byte, 8))                          // target info
+	return buf.Bytes()
+}
+
+// ntlmMessageType decodes the NTLM message in a Proxy-Authorization header for
+// scheme, returning 0 if the header doesn't hold one.
+func ntlmMessageType(header string, scheme string) uint32 {
+	name, data, _ := strings.Cut(header, " ")
+	if name != scheme {
+		return 0
+	}
+	message, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(message) < 12 || !bytes.HasPrefix(message, []byte("NTLMSSP\x00")) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(message[8:12])
+}
+
+// ntlmDialer returns a dialer for p which authenticates with method.
+func ntlmDialer(t *testing.T, p *fakeConnectProxy, method config.ProxyAuthMethod) *httpConnectDialer {
+	t.Helper()
+	d := p.dialer(t, nil)
+	proxyURL := &url.URL{User: url.UserPassword(`CORP\bob`, "secret")}
+	var err error
+	if d.auth, err = newProxyAuthenticator(config.ProxyAuth{Method: method}, proxyURL); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// ntlmProxy returns a fake proxy which answers the negotiate message with
+// challenge, and then answers the authenticate message with final.
+func ntlmProxy(t *testing.T, scheme string, challenge string, final func(w http.ResponseWriter)) *fakeConnectProxy {
+	t.Helper()
+	return newFakeConnectProxy(t, func(w http.ResponseWriter, r *http.Request, round int) {
+		authorization := r.Header.Get("Proxy-Authorization")
+		switch round {
+		case 1:
+			if messageType := ntlmMessageType(authorization, scheme); messageType != ntlmNegotiateType {
+				t.Errorf("expected NTLM negotiate message first, got %q", authorization)
+			}
+			w.Header().Set("Proxy-Authenticate", challenge)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+		case 2:
+			if messageType := ntlmMessageType(authorization, scheme); messageType != ntlmAuthenticateType {
+				t.Errorf("expected NTLM authenticate message second, got %q", authorization)
+			}
+			final(w)
+		default:
+			t.Errorf("unexpected request %d", round)
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+}
+
+func TestNTLMProxyAuth(t *testing.T) {
+	for _, tc := range []struct {
+		method config.ProxyAuthMethod
+		scheme string
+	}{
+		{config.ProxyAuthNTLM, "NTLM"},
+		{config.ProxyAuthNegotiate, "Negotiate"},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			challenge := tc.scheme + " " + base64.StdEncoding.EncodeToString(ntlmChallengeMessage())
+			p := ntlmProxy(t, tc.scheme, challenge, func(w http.ResponseWriter) { acceptTunnel(t, w, "") })
+
+			conn, err := dialContext(t, ntlmDialer(t, p, tc.method))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+
+			// NTLM authenticates the connection, so the whole handshake must
+			// happen on one connection.
+			addrs, _ := p.requests()
+			if len(addrs) != 2 {
+				t.Fatalf("expected 2 requests, got %d", len(addrs))
+			}
+			if addrs[0] != addrs[1] {
+				t.Errorf("expected the handshake on one connection, got %v", addrs)
+			}
+		})
+	}
+}
+
+func TestNTLMProxyAuthMissingChallenge(t *testing.T) {
+	p := newFakeConnectProxy(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+		// Only offers a scheme which wasn't configured.
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	})
+
+	_, err := dialContext(t, ntlmDialer(t, p, config.ProxyAuthNTLM))
+	if !errors.Is(err, ErrProxyAuthNoChallenge) {
+		t.Fatalf("expected ErrProxyAuthNoChallenge, got %v", err)
+	}
+	if addrs, _ := p.requests(); len(addrs) != 1 {
+		t.Errorf("expected no authenticate message without a challenge, got %d requests", len(addrs))
+	}
+}
+
+func TestNTLMProxyAuthRejected(t *testing.T) {
+	challenge := "NTLM " + base64.StdEncoding.EncodeToString(ntlmChallengeMessage())
+	p := ntlmProxy(t, "NTLM", challenge, func(w http.ResponseWriter) {
+		w.Header().Set("Proxy-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	})
+
+	_, err := dialContext(t, ntlmDialer(t, p, config.ProxyAuthNTLM))
+	if !errors.Is(err, ErrProxyAuthRequired) {
+		t.Fatalf("expected ErrProxyAuthRequired, got %v", err)
+	}
+	if addrs, _ := p.requests(); len(addrs) != 2 {
+		t.Errorf("expected the handshake to stop after the final 407, got %d requests", len(addrs))
+	}
+}
+
+func TestKerberosProxyAuthRejected(t *testing.T) {
+	// Kerberos tickets are sent with the first request, so any challenge means
+	// the ticket was rejected.
+	_, err := (&kerberosAuthenticator{}).respond([]string{"Negotiate"})
+	if !errors.Is(err, ErrProxyAuthRequired) {
+		t.Fatalf("expected ErrProxyAuthRequired, got %v", err)
+	}
+}
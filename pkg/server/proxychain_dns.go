@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultDNSTimeout = 5 * time.Second
+	defaultDNSPort    = "53"
+)
+
+var (
+	ErrUnknownDNSResolution = errors.New("unknown proxychain DNS resolution")
+)
+
+// resolvingProxychain resolves destination hostnames before dialing them through
+// a proxychain, so that the proxies only see IP addresses. Hostnames which are
+// routed by the host patterns of proxychain rules are passed on unresolved.
+type resolvingProxychain struct {
+	logger     *zap.Logger
+	resolution config.DNSResolution
+	hosts      map[string]netip.Addr
+	resolver   *net.Resolver
+	timeout    time.Duration
+	chain      Proxychain
+
+	servers    []string
+	nextServer atomic.Uint32
+	throughTCP bool
+
+	// unresolved returns true for destinations which the chain routes by
+	// hostname, and which are therefore never resolved.
+	unresolved func(host string, port uint16) bool
+}
+
+// newResolvingProxychain wraps chain with the DNS configuration in cfg. The chain
+// is returned unchanged if it resolves hostnames remotely with no static hosts.
+func newResolvingProxychain(cfg config.ProxychainDNS, chain Proxychain) (Proxychain, error) {
+	switch cfg.Resolution {
+	case "", config.DNSRemote, config.DNSLocal, config.DNSLocalWithFallback:
+	default:
+		return nil, errors.Wrapf(ErrUnknownDNSResolution, "%v", cfg.Resolution)
+	}
+
+	if (cfg.Resolution == "" || cfg.Resolution == config.DNSRemote) && len(cfg.Hosts) == 0 {
+		return chain, nil
+	}
+
+	r := &resolvingProxychain{
+		logger:     zap.L().With(zap.String("dns_resolution", string(cfg.Resolution))),
+		resolution: cfg.Resolution,
+		hosts:      make(map[string]netip.Addr, len(cfg.Hosts)),
+		resolver:   net.DefaultResolver,
+		timeout:    cfg.Timeout,
+		chain:      chain,
+		throughTCP: cfg.ThroughProxychain,
+	}
+	if r.resolution == "" {
+		r.resolution = config.DNSRemote
+	}
+	if r.timeout == 0 {
+		r.timeout = defaultDNSTimeout
+	}
+
+	for host, addr := range cfg.Hosts {
+		r.hosts[normalizeHost(host)] = addr.Unmap()
+	}
+
+	if routed, ok := chain.(*routedProxychain); ok {
+		r.unresolved = routed.routesHostname
+	}
+
+	for _, server := range cfg.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, defaultDNSPort)
+		}
+		r.servers = append(r.servers, server)
+	}
+
+	if len(r.servers) > 0 || r.throughTCP {
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial:     r.dialDNS,
+		}
+	}
+	return r, nil
+}
+
+// normalizeHost lowercases host and removes any trailing dot.
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// dialDNS connects to the configured DNS servers in turn, through the proxychain
+// if needed. Queries sent through the proxychain use TCP.
+func (r *resolvingProxychain) dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(r.servers) > 0 {
+		address = r.servers[int(r.nextServer.Add(1)-1)%len(r.servers)]
+	}
+	if r.throughTCP {
+		conn, err := r.chain.Dialer().DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not reach DNS server %s through proxychain", address)
+		}
+		return conn, nil
+	}
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// Dialer implements Proxychain.
+func (r *resolvingProxychain) Dialer() proxy.ContextDialer {
+	return r
+}
+
+// lookup resolves host with the configured resolver.
+func (r *resolvingProxychain) lookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	addrs, err := r.resolver.LookupNetIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not resolve %s", host)
+	}
+	return addrs, nil
+}
+
+// DialContext resolves addr according to the DNS configuration and dials it
+// through the proxychain. Each resolved address is tried in turn.
+func (r *resolvingProxychain) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxychain dns")
+	}
+	dialer := r.chain.Dialer()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if r.unresolved != nil {
+		if portNum, err := strconv.ParseUint(port, 10, 16); err == nil && r.unresolved(host, uint16(portNum)) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	if staticAddr, found := r.hosts[normalizeHost(host)]; found {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(staticAddr.String(), port))
+	}
+
+	if r.resolution == config.DNSRemote {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := r.lookup(ctx, network, host)
+	if err != nil {
+		if r.resolution == config.DNSLocalWithFallback && ctx.Err() == nil {
+			r.logger.Debug("Local resolution failed, resolving remotely", zap.String("target_addr", addr),
+				zap.Error(err))
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return nil, err
+	}
+
+	var lastErr error
+	for _, resolved := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(resolved.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Wrapf(lastErr, "all %d addresses of %s failed", len(addrs), host)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+func TestResolvingProxychainKeepsRuleHostnames(t *testing.T) {
+	targets := make(chan string, 2)
+	p := newFakeConnectProxy(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+		targets <- r.Host
+		acceptTunnel(t, w, "")
+	})
+
+	cfg := config.ProxychainConfig{
+		Alternatives: [][]config.Proxy{{{Proxy: config.ProxyURL(p.URL)}}},
+		Rules: []config.ProxychainRule{{
+			Hosts: []string{"*.onion"},
+			Via:   []config.Proxy{{Proxy: config.ProxyURL(p.URL)}},
+		}},
+		DNS: config.ProxychainDNS{Resolution: config.DNSLocal},
+	}
+	chain, err := NewProxychainFromConfig("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := chain.Dialer().DialContext(ctx, "tcp", "example.onion:80")
+	if err != nil {
+		t.Fatalf("expected the hostname to reach the rule hops unresolved: %v", err)
+	}
+	_ = conn.Close()
+
+	if target := <-targets; target != "example.onion:80" {
+		t.Errorf("expected the rule hops to receive the hostname, got %q", target)
+	}
+
+	// Other hostnames are still resolved locally.
+	conn, err = chain.Dialer().DialContext(ctx, "tcp", "localhost:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	if target := <-targets; target != "127.0.0.1:80" && target != "[::1]:80" {
+		t.Errorf("expected other hostnames to be resolved locally, got %q", target)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrEmptyProxychainRule = errors.New("proxychain rule has no hosts, networks or ports to match")
+)
+
+// proxychainRule routes matching destinations through its own proxychain.
+type proxychainRule struct {
+	hosts    []string
+	networks []netip.Prefix
+	ports    []uint16
+	chain    *proxychain
+}
+
+// matches returns true if the destination matches every criteria of the rule.
+// Networks only match destinations which are IP addresses, since hostnames are
+// resolved by the last hop.
+func (r proxychainRule) matches(host string, port uint16) bool {
+	if len(r.hosts) > 0 && !lo.ContainsBy(r.hosts, func(pattern string) bool {
+		matched, _ := path.Match(pattern, host)
+		return matched
+	}) {
+		return false
+	}
+	if len(r.networks) > 0 {
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !lo.ContainsBy(r.networks, func(network netip.Prefix) bool {
+			return network.Contains(addr.Unmap())
+		}) {
+			return false
+		}
+	}
+	if len(r.ports) > 0 && !lo.Contains(r.ports, port) {
+		return false
+	}
+	return true
+}
+
+// routedProxychain selects a proxychain for each destination by rules, using the
+// default proxychain if no rule matches.
+type routedProxychain struct {
+	logger   *zap.Logger
+	rules    []proxychainRule
+	fallback Proxychain
+}
+
+// newRoutedProxychain builds the proxychains of the rules in cfg.
+func newRoutedProxychain(name string, cfg []config.ProxychainRule, fallback Proxychain) (*routedProxychain, error) {
+	r := &routedProxychain{
+		logger:   zap.L(),
+		fallback: fallback,
+	}
+
+	for idx, ruleConf := range cfg {
+		if len(ruleConf.Hosts) == 0 && len(ruleConf.Networks) == 0 && len(ruleConf.Ports) == 0 {
+			return nil, errors.Wrapf(ErrEmptyProxychainRule, "proxychain rule %v", idx)
+		}
+
+		hosts := make([]string, 0, len(ruleConf.Hosts))
+		for _, pattern := range ruleConf.Hosts {
+			pattern = strings.ToLower(pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "proxychain rule %v: invalid host pattern %q", idx, pattern)
+			}
+			hosts = append(hosts, pattern)
+		}
+
+		chain, err := newProxychain(name, ruleConf.Via)
+		if err != nil {
+			return nil, errors.Wrapf(err, "proxychain rule %v", idx)
+		}
+
+		networks := make([]netip.Prefix, 0, len(ruleConf.Networks))
+		for _, network := range ruleConf.Networks {
+			networks = append(networks, network.Masked())
+		}
+
+		r.rules = append(r.rules, proxychainRule{
+			hosts:    hosts,
+			networks: networks,
+			ports:    ruleConf.Ports,
+			chain:    chain,
+		})
+	}
+	return r, nil
+}
+
+// Dialer implements Proxychain.
+func (r *routedProxychain) Dialer() proxy.ContextDialer {
+	return r
+}
+
+// routesHostname returns true if the first rule matching the unresolved host
+// matches it by its host patterns. Such hostnames must reach the rule's hops
+// unresolved, since resolving them would stop the patterns from matching.
+func (r *routedProxychain) routesHostname(host string, port uint16) bool {
+	host = normalizeHost(host)
+	for _, rule := range r.rules {
+		if rule.matches(host, port) {
+			return len(rule.hosts) > 0
+		}
+	}
+	return false
+}
+
+// DialContext dials addr through the proxychain of the first matching rule.
+func (r *routedProxychain) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxychain rules")
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "proxychain rules: invalid port in %s", addr)
+	}
+	host = normalizeHost(host)
+
+	for idx, rule := range r.rules {
+		if rule.matches(host, uint16(port)) {
+			r.logger.Debug("Proxychain rule matched", zap.Int("rule", idx), zap.String("target_addr", addr))
+			return rule.chain.Dialer().DialContext(ctx, network, addr)
+		}
+	}
+	return r.fallback.Dialer().DialContext(ctx, network, addr)
+}
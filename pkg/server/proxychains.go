@@ -1,12 +1,12 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"net/url"
+	"net"
 
 	"github.com/pkg/errors"
 	"github.com/samber/lo"
-	connect_proxy_scheme "github.com/wrouesnel/go.connect-proxy-scheme"
 	"github.com/wrouesnel/proxyreverse/pkg/server/config"
 	"go.uber.org/zap"
 	"golang.org/x/net/proxy"
@@ -31,18 +31,35 @@ func (e ErrInvalidProxySpec) Cause() error {
 
 //nolint:gochecknoinits
 func init() {
-	proxy.RegisterDialerType("http", connect_proxy_scheme.ConnectProxy)
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+	proxy.RegisterDialerType("https", newHTTPSConnectDialer)
+	proxy.RegisterDialerType("ssh", newSSHDialer)
 }
 
 // proxychain implements a dialer which chains successive proxies together in
 // order to reach a target addr.
 type proxychain struct {
-	dialer proxy.ContextDialer
+	dialer   proxy.ContextDialer
+	breakers []*circuitBreaker // breakers are the circuit breakers of the proxy hops
+}
+
+// DialContext fails fast if the circuit to any proxy in the chain is open,
+// otherwise it dials addr through the chain.
+func (pc *proxychain) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	for _, breaker := range pc.breakers {
+		if !breaker.Ready() {
+			return nil, errors.Wrapf(ErrCircuitOpen, "%v", breaker.name)
+		}
+	}
+	return pc.dialer.DialContext(ctx, network, addr)
 }
 
 // Dialer implements Proxychain.
 func (pc *proxychain) Dialer() proxy.ContextDialer {
-	return pc.dialer
+	if len(pc.breakers) == 0 {
+		return pc.dialer
+	}
+	return pc
 }
 
 // Proxychain provides an interface to constructed chains of proxies.
@@ -50,17 +67,55 @@ type Proxychain interface {
 	Dialer() proxy.ContextDialer
 }
 
-// NewProxychainFromConfig creates a new proxychain from the supplied
-// list of configs.
-func NewProxychainFromConfig(cfg []config.Proxy) (Proxychain, error) {
+// NewProxychainFromConfig creates a new proxychain from the supplied config. If
+// the config has multiple alternatives the proxychain fails over between them,
+// and if it has rules they select the proxychain for each destination.
+// Destination hostnames are resolved before the rules are evaluated, unless a
+// rule matches them by hostname. Dials are recorded in the metrics under name.
+func NewProxychainFromConfig(name string, cfg config.ProxychainConfig) (Proxychain, error) {
+	var chain Proxychain
+	var err error
+	if len(cfg.Alternatives) <= 1 {
+		chain, err = newProxychain(name, lo.FirstOrEmpty(cfg.Alternatives))
+	} else {
+		chain, err = newFailoverProxychain(name, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Rules) > 0 {
+		if chain, err = newRoutedProxychain(name, cfg.Rules, chain); err != nil {
+			return nil, err
+		}
+	}
+	if chain, err = newResolvingProxychain(cfg.DNS, chain); err != nil {
+		return nil, err
+	}
+	return &instrumentedProxychain{name: name, chain: chain}, nil
+}
+
+// newProxychain creates a new proxychain from the supplied list of configs.
+// Dials to the hops are recorded in the metrics of the proxychain called name.
+func newProxychain(name string, cfg []config.Proxy) (*proxychain, error) {
 	logger := zap.L()
 	// Initial dialer is a direct dialer
 	var proxyDialer proxy.Dialer = proxy.Direct
+	var breakers []*circuitBreaker
 
 	// Loop through the chain and wrap each stage
 	for idx, proxyConf := range cfg {
-		llogger := logger.With(zap.String("proxy_url", (string)(proxyConf.Proxy)))
+		llogger := logger.With(zap.String("proxy_url", proxyConf.Proxy.Redacted()))
 		llogger.Debug("Construct proxy dialer")
+		// Connections to this proxy are made by the dialer of the previous hop.
+		if proxyConf.Proxy != config.ProxyDirect {
+			proxyDialer = &hopMetricsDialer{forward: proxyDialer, proxychain: name, hop: proxyConf.Proxy.Endpoint()}
+			if breaker := newCircuitBreaker(fmt.Sprintf("proxy:%d:%s", idx, proxyConf.Proxy.Endpoint()),
+				proxyConf.CircuitBreaker); breaker != nil {
+				breakers = append(breakers, breaker)
+				proxyDialer = &breakerDialer{dialer: proxyDialer, breaker: breaker}
+			}
+		}
+
 		switch proxyConf.Proxy {
 		case config.ProxyDirect:
 			if idx == 0 {
@@ -75,19 +130,45 @@ func NewProxychainFromConfig(cfg []config.Proxy) (Proxychain, error) {
 			llogger.Debug("Proxy from environment")
 			newDialer := proxy.FromEnvironmentUsing(proxyDialer)
 			proxyDialer = newDialer
+		case config.ProxyPAC:
+			llogger.Debug("Proxy from PAC file", zap.String("pac_source", proxyConf.PAC.Source))
+			newDialer, err := newPACDialer(proxyConf.PAC, proxyDialer)
+			if err != nil {
+				llogger.Error("PAC file could not be loaded", zap.Error(err))
+				return nil, &ErrInvalidProxySpec{err}
+			}
+			proxyDialer = newDialer
 		default:
 			llogger.Debug("Proxy from explicit URL")
-			proxyURL := lo.Must(url.Parse((string)(proxyConf.Proxy)))
-			newDialer, err := proxy.FromURL(proxyURL, proxyDialer)
+			proxyURL, err := proxyConf.URL()
+			if err != nil {
+				llogger.Error("Proxy URL could not be parsed")
+				return nil, &ErrInvalidProxySpec{err}
+			}
+			newDialer, err := proxyFromURL(proxyURL, proxyDialer)
 			if err != nil {
 				llogger.Error("Proxy from URL failed")
 				return nil, &ErrInvalidProxySpec{err}
 			}
+			if connectDialer, ok := newDialer.(*httpConnectDialer); ok {
+				connectDialer.configureTLS(proxyConf.TLS)
+				if connectDialer.auth, err = newProxyAuthenticator(proxyConf.Auth, proxyURL); err != nil {
+					llogger.Error("Proxy authentication configuration failed", zap.Error(err))
+					return nil, &ErrInvalidProxySpec{err}
+				}
+			}
+			if sshDialer, ok := newDialer.(*sshDialer); ok {
+				if err := sshDialer.configure(proxyConf.SSH); err != nil {
+					llogger.Error("SSH configuration failed", zap.Error(err))
+					return nil, &ErrInvalidProxySpec{err}
+				}
+			}
 			proxyDialer = newDialer
 		}
+		proxyDialer = newTimeoutDialer(proxyDialer, proxyConf.Timeouts.Connect)
 	}
 
-	chain := proxychain{}
+	chain := proxychain{breakers: breakers}
 	chain.dialer = proxyDialer.(proxy.ContextDialer)
 
 	return &chain, nil
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrListenerStartFailed = errors.New("failed to start listener")
+	ErrReloadNeedsRestart  = errors.New("configuration change requires a restart")
+)
+
+// managedListener is a Listener which can be configured before it is started.
+type managedListener interface {
+	Listener
+	// start serves on inherited, or on the listener address if inherited is nil.
+	start(ctx context.Context, inherited net.Listener) error
+	// socket returns the listening socket, or nil if the listener isn't started.
+	socket() net.Listener
+}
+
+// newManagedListener initializes the listener called name without starting it.
+func newManagedListener(name string, cfg config.ListenerConfig, key listenerKey,
+	metrics *serverMetrics,
+) (managedListener, error) {
+	switch listenType := cfg.ListenerType; listenType {
+	case config.SiteConfigTypeHTTPEdge:
+		return newHTTPEdgeListener(name, key, cfg.Timeouts, false, metrics), nil
+	case config.SiteConfigTypeHTTPSEdge:
+		return newHTTPEdgeListener(name, key, cfg.Timeouts, true, metrics), nil
+	case config.SiteConfigTypeTLSPassthrough:
+		return newTLSPassthroughListener(name, key, cfg.Timeouts, metrics), nil
+	case config.SiteConfigTypeTCPForward:
+		return newTCPForwardListener(name, key, cfg.Timeouts, metrics), nil
+	default:
+		return nil, errors.Wrapf(ErrUnknownListenerType, "%v", listenType)
+	}
+}
+
+// runningListener is a started listener and the configuration it was started from.
+type runningListener struct {
+	cfg      config.ListenerConfig
+	key      listenerKey
+	listener managedListener
+}
+
+// runningSite is a site and the cancel function of its backend context.
+type runningSite struct {
+	cfg    config.SiteConfig
+	site   *Site
+	cancel context.CancelFunc
+}
+
+// serverState tracks what is running so a new configuration can be applied by
+// only changing what differs from the running configuration.
+type serverState struct {
+	logger *zap.Logger
+	ctx    context.Context //nolint:containedctx // ctx bounds everything started for the configuration
+	// metrics records the metrics of the listeners and sites
+	metrics *serverMetrics
+
+	mu                sync.Mutex // mu serializes changes to the running configuration
+	cfg               *config.Config
+	proxychainConfigs map[string]config.ProxychainConfig
+	proxychains       map[string]Proxychain
+	listeners         map[string]*runningListener
+	sites             []*runningSite
+	// adminChanged are the hosts of sites added, replaced or removed through the
+	// admin API since the configuration was last applied.
+	adminChanged map[string]bool
+}
+
+func newServerState(ctx context.Context, metrics *serverMetrics) *serverState {
+	return &serverState{
+		logger:            zap.L(),
+		ctx:               ctx,
+		metrics:           metrics,
+		proxychainConfigs: map[string]config.ProxychainConfig{},
+		proxychains:       map[string]Proxychain{},
+		listeners:         map[string]*runningListener{},
+		adminChanged:      map[string]bool{},
+	}
+}
+
+// buildProxychains builds the proxychains of cfg, reusing running proxychains
+// whose configuration is unchanged.
+func (s *serverState) buildProxychains(cfg *config.Config) (map[string]Proxychain, error) {
+	proxychains := map[string]Proxychain{}
+	for name, proxychainConfig := range cfg.Proxychains {
+		if oldConfig, found := s.proxychainConfigs[name]; found && reflect.DeepEqual(oldConfig, proxychainConfig) {
+			proxychains[name] = s.proxychains[name]
+			continue
+		}
+		chain, err := NewProxychainFromConfig(name, proxychainConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "proxychain %v", name)
+		}
+		proxychains[name] = chain
+	}
+	return proxychains, nil
+}
+
+// listenerKeys resolves the address of every listener in cfg and checks that
+// they do not clash.
+func listenerKeys(cfg *config.Config) (map[string]listenerKey, error) {
+	listenPorts := map[listenerKey]string{}
+	listenNames := map[listenerKey]string{}
+	keys := map[string]listenerKey{}
+	for listenerName, listenerConfig := range cfg.Listeners {
+		listenerLogger := zap.L().With(zap.String("listen_addr", listenerConfig.ListenAddr.String()))
+
+		addr, err := netip.ParseAddr(listenerConfig.ListenAddr.Host)
+		if err != nil {
+			listenerLogger.Error("Could not parse supplied listen address",
+				zap.String("listen_addr", listenerConfig.ListenAddr.Host))
+		}
+
+		key := listenerKey{
+			Addr:    netip.AddrPortFrom(addr, listenerConfig.ListenAddr.Port),
+			Network: listenerConfig.ListenAddr.Network,
+		}
+
+		if listenerType, found := listenPorts[key]; found {
+			if listenerType != string(listenerConfig.ListenerType) {
+				listenerLogger.Error("Duplicate listen addresses with different listener types found",
+					zap.String("found", listenerType), zap.String("current", string(listenerConfig.ListenerType)))
+				return nil, ErrDuplicateListeners
+			}
+		}
+
+		if otherName, found := listenNames[key]; found {
+			listenerLogger.Error("Duplicate listener names found", zap.String("listener_name", otherName))
+			return nil, ErrDuplicateListeners
+		}
+
+		listenPorts[key] = string(listenerConfig.ListenerType)
+		listenNames[key] = listenerName
+		keys[listenerName] = key
+	}
+	return keys, nil
+}
+
+// restartFields returns the settings which differ between oldCfg and newCfg but
+// are only applied at startup.
+func restartFields(oldCfg, newCfg *config.Config) []string {
+	fields := []string{}
+	if oldCfg.Admin.ListenAddr != newCfg.Admin.ListenAddr {
+		fields = append(fields, "admin.listen_addr")
+	}
+	if oldCfg.Admin.Socket != newCfg.Admin.Socket {
+		fields = append(fields, "admin.socket")
+	}
+	if oldCfg.Metrics.ListenAddr != newCfg.Metrics.ListenAddr {
+		fields = append(fields, "metrics.listen_addr")
+	}
+	if oldCfg.Metrics.Path != newCfg.Metrics.Path {
+		fields = append(fields, "metrics.path")
+	}
+	return fields
+}
+
+// adminToken returns the bearer token of the admin API in the running
+// configuration, so a reload can rotate it.
+func (s *serverState) adminToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg == nil {
+		return ""
+	}
+	return s.cfg.Admin.Token()
+}
+
+// takeSite removes and returns a running site which can be reused for siteCfg.
+func takeSite(sites []*runningSite, siteCfg config.SiteConfig, pc Proxychain) ([]*runningSite, *runningSite) {
+	for idx, running := range sites {
+		if running.site.Proxychain == pc && reflect.DeepEqual(running.cfg, siteCfg) {
+			return append(sites[:idx:idx], sites[idx+1:]...), running
+		}
+	}
+	return sites, nil
+}
+
+// apply changes the running server to match cfg. Proxychains, sites and
+// listeners which are unchanged are kept, so their connections are unaffected.
+// If cfg is invalid nothing is changed. Changes made through the admin API are
+// replaced by cfg.
+func (s *serverState) apply(cfg *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.applyLocked(cfg); err != nil {
+		return err
+	}
+	if len(s.adminChanged) > 0 {
+		s.logger.Warn("Configuration reload discarded site changes made through the admin API",
+			zap.Strings("hosts", slices.Sorted(maps.Keys(s.adminChanged))))
+		s.adminChanged = map[string]bool{}
+	}
+	return nil
+}
+
+// applyLocked implements apply. s.mu must be held.
+//
+//nolint:funlen,gocognit,gocyclo,cyclop
+func (s *serverState) applyLocked(cfg *config.Config) error {
+	logger := s.logger
+	ctx := s.ctx
+
+	if cfg == nil {
+		return ErrNilConfig
+	}
+
+	if err := s.metrics.checkLabels(cfg.Metrics); err != nil {
+		return err
+	}
+	if s.cfg != nil {
+		if fields := restartFields(s.cfg, cfg); len(fields) > 0 {
+			return errors.Wrapf(ErrReloadNeedsRestart, "%v", strings.Join(fields, ", "))
+		}
+	}
+
+	logger.Debug("Constructing proxychains")
+	proxychains, err := s.buildProxychains(cfg)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Constructing the list of addresses to listen on")
+	keys, err := listenerKeys(cfg)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Initializing backends")
+	unused := append([]*runningSite{}, s.sites...)
+	sites := []*runningSite{}
+	// discard stops the backends which were started for cfg if it is rejected.
+	discard := func() {
+		for _, running := range sites {
+			if !lo.Contains(s.sites, running) {
+				running.cancel()
+			}
+		}
+	}
+
+	siteMapping := map[siteKey]*Site{}
+	listenerSites := map[string][]*Site{}
+	for _, siteCfg := range cfg.Sites {
+		siteLogger := zap.L().With(zap.String("host", siteCfg.Host))
+
+		pc, found := proxychains[siteCfg.Proxychain]
+		if !found {
+			siteLogger.Error("Requested proxychain config was not found", zap.String("proxychain", siteCfg.Proxychain))
+			discard()
+			return errors.Wrapf(ErrProxychainNotFound, "%v", siteCfg.Proxychain)
+		}
+
+		var running *runningSite
+		unused, running = takeSite(unused, siteCfg, pc)
+		if running == nil {
+			siteCtx, cancel := context.WithCancel(ctx)
+			backend, err := NewHTTPBackend(siteCtx, siteCfg.Backend, pc)
+			if err != nil {
+				cancel()
+				siteLogger.Error("Could not initialize backend", zap.Error(err))
+				discard()
+				return ErrBackendInitFailed
+			}
+			running = &runningSite{
+				cfg: siteCfg,
+				site: &Site{
+					Host:          siteCfg.Host,
+					Config:        siteCfg,
+					Proxychain:    pc,
+					Handler:       backend,
+					MetricsLabels: s.metrics.siteLabels(siteCfg),
+				},
+				cancel: cancel,
+			}
+		}
+		sites = append(sites, running)
+
+		for idx, listenerName := range siteCfg.Listener {
+			key := siteKey{
+				Host:     siteCfg.Host,
+				Listener: listenerName,
+			}
+
+			if _, found := siteMapping[key]; found {
+				siteLogger.Error("Site with matching hostname already attached to this listener",
+					zap.String("host", siteCfg.Host), zap.String("listener_name", listenerName),
+					zap.Int("site_idx", idx))
+				discard()
+				return ErrHostListenerClash
+			}
+
+			if _, found := keys[listenerName]; !found {
+				siteLogger.Error("Listener was not found when attempting to attach site",
+					zap.String("listener_name", listenerName))
+				discard()
+				return ErrListenerNotFound
+			}
+
+			siteMapping[key] = running.site
+			listenerSites[listenerName] = append(listenerSites[listenerName], running.site)
+		}
+	}
+
+	logger.Debug("Attaching backends to listeners")
+	// Listeners which are unchanged are kept running, the rest are prepared with
+	// their sites so every listener is validated before anything is changed.
+	listeners := map[string]*runningListener{}
+	pending := map[string]*runningListener{}
+	for listenerName, listenerConfig := range cfg.Listeners {
+		attachLogger := zap.L().With(zap.String("listener_name", listenerName))
+		key := keys[listenerName]
+
+		if old, found := s.listeners[listenerName]; found && old.key == key && reflect.DeepEqual(old.cfg, listenerConfig) {
+			// Check the sites on a throwaway listener since the running one can
+			// only be changed once the whole configuration is known to be good.
+			check, err := newManagedListener(listenerName, listenerConfig, key, nil)
+			if err == nil {
+				err = check.SetSites(listenerSites[listenerName])
+			}
+			if err != nil {
+				attachLogger.Error("Failed to attach site to listener", zap.Error(err))
+				discard()
+				return errors.Wrapf(ErrAttachSiteToListenerFailed, "%v: %v", listenerName, err)
+			}
+			listeners[listenerName] = old
+			continue
+		}
+
+		listener, err := newManagedListener(listenerName, listenerConfig, key, s.metrics)
+		if err != nil {
+			attachLogger.Error("Unimplemented listener type.")
+			discard()
+			return err
+		}
+		if err := listener.SetSites(listenerSites[listenerName]); err != nil {
+			attachLogger.Error("Failed to attach site to listener", zap.Error(err))
+			discard()
+			return errors.Wrapf(ErrAttachSiteToListenerFailed, "%v: %v", listenerName, err)
+		}
+		pending[listenerName] = &runningListener{cfg: listenerConfig, key: key, listener: listener}
+	}
+
+	// Listeners replacing one on the same address take over its socket, so the
+	// address keeps accepting connections and the old listener keeps running if
+	// the replacement can't be started.
+	stopping := map[string]*runningListener{}
+	replaced := map[listenerKey]*runningListener{}
+	for listenerName, old := range s.listeners {
+		if listeners[listenerName] != old {
+			stopping[listenerName] = old
+			replaced[old.key] = old
+		}
+	}
+
+	logger.Debug("Starting the listeners")
+	started := []*runningListener{}
+	for listenerName, running := range pending {
+		var inherited net.Listener
+		var err error
+		if old, found := replaced[running.key]; found {
+			inherited, err = duplicateListener(old.listener.socket())
+		}
+		if err == nil {
+			err = running.listener.start(ctx, inherited)
+		}
+		if err != nil {
+			zap.L().Error("Failed to create listener from config", zap.String("listener_name", listenerName))
+			if inherited != nil {
+				_ = inherited.Close()
+			}
+			for _, startedListener := range started {
+				_ = startedListener.listener.Close()
+			}
+			discard()
+			return errors.Wrapf(ErrListenerStartFailed, "%v: %v", listenerName, err)
+		}
+		started = append(started, running)
+		listeners[listenerName] = running
+	}
+
+	// From here on the new configuration is committed.
+	for listenerName, running := range listeners {
+		if running == s.listeners[listenerName] {
+			if err := running.listener.SetSites(listenerSites[listenerName]); err != nil {
+				zap.L().Error("Failed to attach site to listener", zap.String("listener_name", listenerName),
+					zap.Error(err))
+			}
+		}
+	}
+
+	for listenerName, old := range stopping {
+		zap.L().Info("Stopping listener", zap.String("listener_name", listenerName),
+			zap.String("addr", old.key.Addr.String()))
+		if err := old.listener.Close(); err != nil {
+			zap.L().Error("Got error while stopping listener", zap.String("listener_name", listenerName),
+				zap.Error(err))
+		}
+	}
+
+	for _, running := range unused {
+		running.cancel()
+	}
+
+	s.cfg = cfg
+	s.proxychainConfigs = cfg.Proxychains
+	s.proxychains = proxychains
+	s.listeners = listeners
+	s.sites = sites
+
+	return nil
+}
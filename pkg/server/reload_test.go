@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+// newTestBackend starts an HTTP server which answers every request with body.
+func newTestBackend(t *testing.T, body string) config.HostSpec {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(backend.Close)
+	return testHostSpec(t, backend.Listener.Addr().String())
+}
+
+// testHostSpec parses a host:port address.
+func testHostSpec(t *testing.T, addr string) config.HostSpec {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.HostSpec{Host: host, Port: uint16(port), Network: "tcp"}
+}
+
+// freeListenAddr returns a loopback address which is not in use.
+func freeListenAddr(t *testing.T) config.HostSpec {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return testHostSpec(t, addr)
+}
+
+// newTestReloadConfig returns a configuration with an http-edge listener called
+// web on listenAddr serving a site for each backend.
+func newTestReloadConfig(listenAddr config.HostSpec, backends map[string]config.HostSpec) *config.Config {
+	cfg := &config.Config{
+		Proxychains: map[string]config.ProxychainConfig{"direct": {}},
+		Listeners: map[string]config.ListenerConfig{
+			"web": {ListenAddr: listenAddr, ListenerType: config.SiteConfigTypeHTTPEdge},
+		},
+	}
+	for host, target := range backends {
+		cfg.Sites = append(cfg.Sites, config.SiteConfig{
+			Listener:   []string{"web"},
+			Host:       host,
+			Proxychain: "direct",
+			Backend:    config.BackendConfig{Target: target},
+		})
+	}
+	return cfg
+}
+
+// newTestServerState returns a serverState which is stopped when the test ends.
+func newTestServerState(t *testing.T) *serverState {
+	t.Helper()
+	metrics, err := newServerMetrics(config.MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newServerState(ctx, metrics)
+}
+
+// getSite requests the site host from the listener at addr.
+func getSite(addr config.HostSpec, host string) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   5 * time.Second,
+	}
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", addr.HostPort()), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Host = host
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+// runningSiteFor returns the running site for host.
+func runningSiteFor(s *serverState, host string) *runningSite {
+	running, _ := lo.Find(s.sites, func(running *runningSite) bool { return running.cfg.Host == host })
+	return running
+}
+
+func TestReloadReusesUnchangedSites(t *testing.T) {
+	listenAddr := freeListenAddr(t)
+	backendA := newTestBackend(t, "a")
+	backendB := newTestBackend(t, "b")
+	backendC := newTestBackend(t, "c")
+
+	s := newTestServerState(t)
+	if err := s.apply(newTestReloadConfig(listenAddr, map[string]config.HostSpec{
+		"a.example": backendA, "b.example": backendB,
+	})); err != nil {
+		t.Fatal(err)
+	}
+	oldA, oldB := runningSiteFor(s, "a.example"), runningSiteFor(s, "b.example")
+	oldListener := s.listeners["web"]
+
+	if err := s.apply(newTestReloadConfig(listenAddr, map[string]config.HostSpec{
+		"a.example": backendA, "b.example": backendC,
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	if runningSiteFor(s, "a.example") != oldA {
+		t.Error("expected the unchanged site to be reused")
+	}
+	if runningSiteFor(s, "b.example") == oldB {
+		t.Error("expected the changed site to be rebuilt")
+	}
+	if s.listeners["web"] != oldListener {
+		t.Error("expected the unchanged listener to be reused")
+	}
+
+	for host, expected := range map[string]string{"a.example": "a", "b.example": "c"} {
+		body, err := getSite(listenAddr, host)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		if body != expected {
+			t.Errorf("%s: expected the response from backend %q, got %q", host, expected, body)
+		}
+	}
+}
+
+func TestReloadChangedListenerKeepsAccepting(t *testing.T) {
+	listenAddr := freeListenAddr(t)
+	backends := map[string]config.HostSpec{"a.example": newTestBackend(t, "a")}
+
+	s := newTestServerState(t)
+	if err := s.apply(newTestReloadConfig(listenAddr, backends)); err != nil {
+		t.Fatal(err)
+	}
+	oldListener := s.listeners["web"]
+
+	// Keep requesting the site while the listener is swapped.
+	var failures atomic.Int64
+	var requests atomic.Int64
+	var lastErr atomic.Value
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				requests.Add(1)
+				if _, err := getSite(listenAddr, "a.example"); err != nil {
+					failures.Add(1)
+					lastErr.Store(err)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	changed := newTestReloadConfig(listenAddr, backends)
+	web := changed.Listeners["web"]
+	web.Timeouts.ReadHeader = 30 * time.Second
+	changed.Listeners["web"] = web
+	err := s.apply(changed)
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.listeners["web"] == oldListener {
+		t.Fatal("expected the changed listener to be replaced")
+	}
+	if failures.Load() > 0 {
+		t.Errorf("expected no failed requests during the swap, got %d of %d: %v",
+			failures.Load(), requests.Load(), lastErr.Load())
+	}
+	if body, err := getSite(listenAddr, "a.example"); err != nil || body != "a" {
+		t.Errorf("expected the replacement listener to serve the site, got %q: %v", body, err)
+	}
+}
+
+func TestReloadInvalidConfigKeepsState(t *testing.T) {
+	listenAddr := freeListenAddr(t)
+	backends := map[string]config.HostSpec{"a.example": newTestBackend(t, "a")}
+
+	s := newTestServerState(t)
+	cfg := newTestReloadConfig(listenAddr, backends)
+	if err := s.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	oldSite := runningSiteFor(s, "a.example")
+	oldListener := s.listeners["web"]
+
+	missingListener := newTestReloadConfig(listenAddr, backends)
+	missingListener.Sites[0].Listener = []string{"missing"}
+	missingProxychain := newTestReloadConfig(listenAddr, backends)
+	missingProxychain.Sites[0].Proxychain = "missing"
+	adminChanged := newTestReloadConfig(listenAddr, backends)
+	adminChanged.Admin.ListenAddr = freeListenAddr(t)
+
+	for name, tc := range map[string]struct {
+		cfg      *config.Config
+		expected error
+	}{
+		"missing listener":   {missingListener, ErrListenerNotFound},
+		"missing proxychain": {missingProxychain, ErrProxychainNotFound},
+		"admin changed":      {adminChanged, ErrReloadNeedsRestart},
+	} {
+		if err := s.apply(tc.cfg); !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", name, tc.expected, err)
+		}
+		if s.cfg != cfg || runningSiteFor(s, "a.example") != oldSite || s.listeners["web"] != oldListener {
+			t.Errorf("%s: expected the running state to be kept", name)
+		}
+		if body, err := getSite(listenAddr, "a.example"); err != nil || body != "a" {
+			t.Errorf("%s: expected the site to keep serving, got %q: %v", name, body, err)
+		}
+	}
+}
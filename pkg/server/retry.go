@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+const (
+	defaultRetryBackoff       = 100 * time.Millisecond
+	defaultRetryMaxBackoff    = 2 * time.Second
+	defaultRetryMaxBodyBuffer = 64 * 1024
+	// retryDrainLimit is the most of a discarded response body which is read so
+	// the connection can be reused.
+	retryDrainLimit = 4096
+)
+
+// idempotentMethods are the methods which RFC 9110 defines as idempotent.
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// retryPolicy decides whether failed backend requests are retried.
+type retryPolicy struct {
+	cfg config.RetryPolicy
+}
+
+// enabled returns true if requests may be attempted more than once.
+func (p retryPolicy) enabled() bool {
+	return p.cfg.MaxAttempts > 1
+}
+
+// retryableMethod returns true if the policy allows requests with method to be
+// retried.
+func (p retryPolicy) retryableMethod(method string) bool {
+	return p.cfg.NonIdempotent || slices.Contains(idempotentMethods, method)
+}
+
+// prepareBody buffers the outbound request body so it can be replayed if it is
+// small enough. It returns true if the body can be replayed with GetBody.
+// Bodies of requests which can never be retried are not buffered.
+func (p retryPolicy) prepareBody(outbound *http.Request) bool {
+	if !p.enabled() || outbound.Body == nil || !p.retryableMethod(outbound.Method) {
+		return false
+	}
+
+	maxBuffer := p.cfg.MaxBodyBuffer
+	if maxBuffer == 0 {
+		maxBuffer = defaultRetryMaxBodyBuffer
+	}
+	if outbound.ContentLength > maxBuffer {
+		return false
+	}
+
+	original := outbound.Body
+	buf, err := io.ReadAll(io.LimitReader(original, maxBuffer+1))
+	if err != nil || int64(len(buf)) > maxBuffer {
+		// Too large (or broken) - stream what was read followed by the rest.
+		outbound.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), original), original}
+		return false
+	}
+	_ = original.Close()
+
+	outbound.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	outbound.Body, _ = outbound.GetBody()
+	return true
+}
+
+// canRetry returns true if the request may be attempted again after attempt.
+func (p retryPolicy) canRetry(outbound *http.Request, replayable bool, attempt int) bool {
+	if attempt >= int(p.cfg.MaxAttempts) {
+		return false
+	}
+	if !replayable && outbound.Body != nil {
+		return false
+	}
+	return p.retryableMethod(outbound.Method)
+}
+
+// retryOnError returns true if transport errors should be retried.
+func (p retryPolicy) retryOnError() bool {
+	return p.cfg.OnError
+}
+
+// retryOnStatus returns true if the response status should be retried.
+func (p retryPolicy) retryOnStatus(status int) bool {
+	return slices.Contains(p.cfg.OnStatus, status)
+}
+
+// wait sleeps for the exponential backoff delay following attempt.
+func (p retryPolicy) wait(ctx context.Context, attempt int) error {
+	backoff := p.cfg.Backoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := p.cfg.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	delay := backoff << (attempt - 1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "retry wait")
+	case <-timer.C:
+		return nil
+	}
+}
+
+// discardResponse drains a small amount of the response body and closes it so
+// the connection can be reused.
+func discardResponse(resp *http.Response) {
+	_, _ = io.CopyN(io.Discard, resp.Body, retryDrainLimit)
+	_ = resp.Body.Close()
+}
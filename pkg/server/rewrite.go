@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+)
+
+// responseRewriter maps backend origins in response headers back to the public
+// site so redirects and cookies keep working for the client.
+type responseRewriter struct {
+	cfg config.ResponseRewrite
+}
+
+// enabled returns true if any rewriting is configured.
+func (r responseRewriter) enabled() bool {
+	return r.cfg.Location || r.cfg.CookieDomain || r.cfg.CookiePath
+}
+
+// rewriteContext holds the per-request information needed to map backend URLs
+// to public URLs.
+type rewriteContext struct {
+	publicScheme string
+	publicHost   string
+	backendHosts []string            // backendHosts are the hostnames considered to be the backend origin
+	mapPath      func(string) string // mapPath converts a backend path to a public path
+}
+
+// isBackendHost returns true if host is one of the backend origin hostnames.
+func (c rewriteContext) isBackendHost(host string) bool {
+	for _, backendHost := range c.backendHosts {
+		if strings.EqualFold(host, backendHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBackendDomain returns true if a cookie domain covers any backend hostname.
+func (c rewriteContext) isBackendDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	for _, backendHost := range c.backendHosts {
+		lowerHost := strings.ToLower(backendHost)
+		lowerDomain := strings.ToLower(domain)
+		if lowerHost == lowerDomain || strings.HasSuffix(lowerHost, "."+lowerDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteURL maps an absolute backend URL or absolute path to the public site.
+func (c rewriteContext) rewriteURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+
+	if u.Host == "" {
+		if u.Scheme != "" || !strings.HasPrefix(u.Path, "/") {
+			// Not something we can map
+			return value
+		}
+	} else {
+		if !c.isBackendHost(u.Hostname()) {
+			return value
+		}
+		u.Scheme = c.publicScheme
+		u.Host = c.publicHost
+	}
+
+	u.Path = c.mapPath(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+// rewriteRefresh rewrites the url parameter of a Refresh header.
+func (c rewriteContext) rewriteRefresh(value string) string {
+	parts := strings.Split(value, ";")
+	for idx, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		if len(trimmed) > 4 && strings.EqualFold(trimmed[:4], "url=") {
+			parts[idx] = " " + trimmed[:4] + c.rewriteURL(strings.Trim(trimmed[4:], "'\""))
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// rewriteCookie rewrites the Domain and Path attributes of a Set-Cookie header.
+func (c rewriteContext) rewriteCookie(value string, rewriteDomain bool, rewritePath bool) string {
+	publicHostname, _, err := net.SplitHostPort(c.publicHost)
+	if err != nil {
+		publicHostname = c.publicHost
+	}
+	// Browsers reject Domain attributes for IPs and single label names, so
+	// those cookies are made host-only instead.
+	dropDomain := net.ParseIP(publicHostname) != nil || !strings.Contains(publicHostname, ".")
+
+	attrs := strings.Split(value, ";")
+	result := attrs[:1]
+	for _, attr := range attrs[1:] {
+		name, attrValue, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		switch {
+		case rewriteDomain && strings.EqualFold(name, "domain") && c.isBackendDomain(attrValue):
+			if dropDomain {
+				continue
+			}
+			attr = " " + name + "=" + publicHostname
+		case rewritePath && strings.EqualFold(name, "path") && strings.HasPrefix(attrValue, "/"):
+			attr = " " + name + "=" + c.mapPath(attrValue)
+		}
+		result = append(result, attr)
+	}
+	return strings.Join(result, ";")
+}
+
+// apply rewrites the response headers.
+func (r responseRewriter) apply(header http.Header, ctx rewriteContext) {
+	if r.cfg.Location {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if value := header.Get(name); value != "" {
+				header.Set(name, ctx.rewriteURL(value))
+			}
+		}
+		if value := header.Get("Refresh"); value != "" {
+			header.Set("Refresh", ctx.rewriteRefresh(value))
+		}
+	}
+
+	if r.cfg.CookieDomain || r.cfg.CookiePath {
+		cookies := header["Set-Cookie"]
+		for idx, cookie := range cookies {
+			cookies[idx] = ctx.rewriteCookie(cookie, r.cfg.CookieDomain, r.cfg.CookiePath)
+		}
+	}
+}
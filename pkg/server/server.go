@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"net/http"
 	"net/netip"
 
 	"github.com/pkg/errors"
@@ -35,142 +36,59 @@ type siteKey struct {
 	Listener string
 }
 
-// Server implements the Pathfinding Proxy Server.
-func Server(ctx context.Context, assets assets.Config, sc ServerCommand, cfg *config.Config) error {
+// Site is a configured site which is ready to be attached to listeners.
+type Site struct {
+	Host       string            // Host is the hostname pattern the site responds to
+	Config     config.SiteConfig // Config is the configuration the site was built from
+	Proxychain Proxychain        // Proxychain is the chain used to reach the backend
+	Handler    http.Handler      // Handler serves HTTP requests for the site
+	// MetricsLabels are the values of the extra metrics labels for the site.
+	MetricsLabels []string
+}
+
+// Server implements the Pathfinding Proxy Server. Each configuration received
+// from reloads is applied to the running server. If it cannot be applied the
+// running configuration is kept.
+func Server(ctx context.Context, assets assets.Config, sc ServerCommand, cfg *config.Config,
+	reloads <-chan *config.Config,
+) error {
 	logger := zap.L()
 
 	if cfg == nil {
 		return ErrNilConfig
 	}
 
-	logger.Debug("Constructing proxychains")
-	proxychains := map[string]Proxychain{}
-	for name, proxychainConfig := range cfg.Proxychains {
-		chain, err := NewProxychainFromConfig(proxychainConfig)
-		if err != nil {
-			return err
-		}
-		proxychains[name] = chain
+	metrics, err := newServerMetrics(cfg.Metrics)
+	if err != nil {
+		return err
 	}
 
-	logger.Debug("Constructing the list of addresses to listen on")
-	listenPorts := map[listenerKey]string{}
-	listenNames := map[listenerKey]string{}
-	for listenerName, listenerConfig := range cfg.Listeners {
-		listenerLogger := zap.L().With(zap.String("listen_addr", listenerConfig.ListenAddr.String()))
-
-		addr, err := netip.ParseAddr(listenerConfig.ListenAddr.Host)
-		if err != nil {
-			listenerLogger.Error("Could not parse supplied listen address",
-				zap.String("listen_addr", listenerConfig.ListenAddr.Host))
-		}
-
-		key := listenerKey{
-			Addr:    netip.AddrPortFrom(addr, listenerConfig.ListenAddr.Port),
-			Network: listenerConfig.ListenAddr.Network,
-		}
-
-		if listenerType, found := listenPorts[key]; found {
-			if listenerType != string(listenerConfig.ListenerType) {
-				listenerLogger.Error("Duplicate listen addresses with different listener types found",
-					zap.String("found", listenerType), zap.String("current", string(listenerConfig.ListenerType)))
-				return ErrDuplicateListeners
-			}
-		}
-
-		if listenerName, found := listenPorts[key]; found {
-			listenerLogger.Error("Duplicate listener names found", zap.String("listener_name", listenerName))
-			return ErrDuplicateListeners
-		}
-
-		listenPorts[key] = string(listenerConfig.ListenerType)
-		listenNames[key] = listenerName
+	state := newServerState(ctx, metrics)
+	if err := state.apply(cfg); err != nil {
+		return err
 	}
 
-	logger.Debug("Starting the listeners")
-	listeners := map[string]Listener{}
-	for key, listenType := range listenPorts {
-		siteLogger := zap.L().With(
-			zap.String("addr", key.Addr.String()),
-			zap.String("network", key.Network),
-			zap.String("listener_type", listenType))
-
-		siteLogger.Debug("Starting listener")
-
-		var listener Listener
-		var err error
-
-		switch listenType {
-		case (string)(config.SiteConfigTypeHTTPEdge):
-			listener, err = NewHTTPEdgeListener(ctx, key)
-		default:
-			siteLogger.Error("Unimplemented listener type.")
-			return errors.Wrapf(ErrUnknownListenerType, "%v", listenType)
-		}
-
-		if err != nil {
-			siteLogger.Error("Failed to create listener from config")
-		}
-
-		listenerName := listenNames[key]
-		listeners[listenerName] = listener
+	if err := startMetrics(ctx, cfg.Metrics, metrics); err != nil {
+		return err
 	}
 
-	logger.Debug("Initializing backends")
-	httpSiteMapping := map[siteKey]*HTTPBackend{}
-	for _, siteCfg := range cfg.Sites {
-		siteLogger := zap.L().With(zap.String("host", siteCfg.Host))
-
-		pc, found := proxychains[siteCfg.Proxychain]
-		if !found {
-			siteLogger.Error("Requested proxychain config was not found", zap.String("proxychain", siteCfg.Proxychain))
-			return errors.Wrapf(ErrProxychainNotFound, "%v", siteCfg.Proxychain)
-		}
-
-		backend, err := NewHTTPBackend(siteCfg.Backend, pc)
-		if err != nil {
-			siteLogger.Error("Could not initialize backend", zap.Error(err))
-			return ErrBackendInitFailed
-		}
-
-		for idx, listenerName := range siteCfg.Listener {
-			key := siteKey{
-				Host:     siteCfg.Host,
-				Listener: listenerName,
-			}
-
-			if _, found := httpSiteMapping[key]; found {
-				siteLogger.Error("Site with matching hostname already attached to this listener",
-					zap.String("host", siteCfg.Host), zap.String("listener_name", listenerName),
-					zap.Int("site_idx", idx))
-				return ErrHostListenerClash
-			}
-
-			httpSiteMapping[key] = backend
-		}
+	if err := startAdminAPI(ctx, cfg.Admin, state); err != nil {
+		return err
 	}
 
-	logger.Debug("Attaching backends to listeners")
-	for key, backend := range httpSiteMapping {
-		attachLogger := zap.L().With(
-			zap.String("listener_name", key.Listener),
-			zap.String("host", key.Host))
-
-		listener, found := listeners[key.Listener]
-		if !found {
-			attachLogger.Error("Listener was not found when attempting to attach site")
-			return ErrListenerNotFound
-		}
-
-		if err := listener.AddSite(key.Host, backend); err != nil {
-			attachLogger.Error("Failed to attach site to listener", zap.Error(err))
-			return ErrAttachSiteToListenerFailed
+	logger.Info("Startup complete")
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Shutting down")
+			return nil
+		case newCfg := <-reloads:
+			logger.Info("Reloading configuration")
+			if err := state.apply(newCfg); err != nil {
+				logger.Error("Configuration reload failed", zap.Error(err))
+				continue
+			}
+			logger.Info("Configuration reloaded")
 		}
 	}
-
-	logger.Info("Startup complete")
-	<-ctx.Done()
-	logger.Info("Shutting down")
-
-	return nil
 }
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksDialer dials through a SOCKS5 proxy with the golang.org/x/net dialer.
+// The connections that dialer returns hide the CloseWrite method of the
+// tunnel, so each dial keeps hold of the tunnel to half-close it.
+type socksDialer struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+}
+
+// proxyFromURL returns the dialer for proxyURL, reaching the proxy with forward.
+func proxyFromURL(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		// Check the URL is usable up front.
+		if _, err := proxy.FromURL(proxyURL, forward); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+		return &socksDialer{proxyURL: proxyURL, forward: forward}, nil
+	default:
+		return proxy.FromURL(proxyURL, forward) //nolint:wrapcheck
+	}
+}
+
+// Dial implements proxy.Dialer.
+func (d *socksDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer.
+func (d *socksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var tunnel net.Conn
+	dialer, err := proxy.FromURL(d.proxyURL, &tunnelDialer{forward: d.forward, tunnel: &tunnel})
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	conn, err := dialForward(ctx, dialer, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &socksConn{Conn: conn, tunnel: tunnel}, nil
+}
+
+// tunnelDialer records the connection made to the SOCKS proxy.
+type tunnelDialer struct {
+	forward proxy.Dialer
+	tunnel  *net.Conn
+}
+
+// Dial implements proxy.Dialer.
+func (d *tunnelDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer.
+func (d *tunnelDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialForward(ctx, d.forward, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	*d.tunnel = conn
+	return conn, nil
+}
+
+// socksConn is a connection through a SOCKS proxy.
+type socksConn struct {
+	net.Conn
+	tunnel net.Conn
+}
+
+// CloseWrite implements closeWriter if the tunnel to the proxy does.
+func (c *socksConn) CloseWrite() error {
+	if cw, ok := c.tunnel.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
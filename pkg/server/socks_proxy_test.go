@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// newFakeSOCKSProxy returns the address of a SOCKS5 proxy which echoes the data
+// sent through each tunnel, and then sends "done" once the client has finished
+// sending.
+func newFakeSOCKSProxy(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSOCKS(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveFakeSOCKS(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Greeting: version, methods. No authentication is accepted.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, reader, int64(header[1])); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0})
+
+	// Request: version, command, reserved, address type, address, port.
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return
+	}
+	var addrLen int64
+	switch request[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		addrLen = int64(length)
+	}
+	if _, err := io.CopyN(io.Discard, reader, addrLen+2); err != nil {
+		return
+	}
+	reply := []byte{5, 0, 0, 1, 0, 0, 0, 0}
+	reply = binary.BigEndian.AppendUint16(reply, 0)
+	_, _ = conn.Write(reply)
+
+	_, _ = io.Copy(conn, reader)
+	_, _ = conn.Write([]byte("done"))
+}
+
+// checkHalfClose sends ping through conn, half-closes it and checks the echo
+// and the reply to the half-close arrive.
+func checkHalfClose(t *testing.T, conn net.Conn, expected string) {
+	t.Helper()
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		t.Fatalf("expected %T to support half-closing", conn)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != expected {
+		t.Errorf("expected %q after half-closing, got %q", expected, received)
+	}
+}
+
+func TestSOCKSDialerHalfClose(t *testing.T) {
+	dialer, err := proxyFromURL(&url.URL{Scheme: "socks5", Host: newFakeSOCKSProxy(t)}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialForward(ctx, dialer, "tcp", "backend.internal:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkHalfClose(t, conn, "pingdone")
+}
+
+func TestConnectDialerHalfClose(t *testing.T) {
+	for _, greeting := range []string{"", "greeting\n"} {
+		p := newFakeConnectProxy(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+			acceptTunnel(t, w, greeting)
+		})
+		conn, err := dialContext(t, p.dialer(t, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkHalfClose(t, conn, greeting+"ping")
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultSSHPort              = "22"
+	defaultSSHKeepaliveInterval = 30 * time.Second
+)
+
+var (
+	ErrSSHNeedsUser     = errors.New("ssh hop requires a username")
+	ErrSSHNoKnownHosts  = errors.New("no known_hosts file to verify the ssh host key with")
+	ErrSSHNoAuthMethods = errors.New("no ssh keys, agent or password available")
+)
+
+// defaultSSHIdentityFiles are the keys tried if no identity files are configured.
+//
+//nolint:gochecknoglobals
+var defaultSSHIdentityFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// sshDialer dials addresses with direct-tcpip channels from an SSH host. A single
+// SSH session is shared by all connections and reopened when it is lost. The SSH
+// host is reached with the forward dialer.
+type sshDialer struct {
+	logger  *zap.Logger
+	forward proxy.Dialer
+	sshAddr string
+	user    *url.Userinfo
+
+	signers           []ssh.Signer
+	agentSocket       string
+	hostKeyCallback   ssh.HostKeyCallback
+	keepaliveInterval time.Duration
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// newSSHDialer implements the proxy.RegisterDialerType constructor for SSH hosts.
+func newSSHDialer(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	if proxyURL.User == nil || proxyURL.User.Username() == "" {
+		return nil, errors.Wrapf(ErrSSHNeedsUser, "%s", proxyURL.Host)
+	}
+	port := proxyURL.Port()
+	if port == "" {
+		port = defaultSSHPort
+	}
+	sshAddr := net.JoinHostPort(proxyURL.Hostname(), port)
+	return &sshDialer{
+		logger:            zap.L().With(zap.String("ssh_addr", sshAddr)),
+		forward:           forward,
+		sshAddr:           sshAddr,
+		user:              proxyURL.User,
+		keepaliveInterval: defaultSSHKeepaliveInterval,
+	}, nil
+}
+
+// expandHome expands a leading ~/ in path to the home directory.
+func expandHome(path string) (string, error) {
+	rest, found := strings.CutPrefix(path, "~/")
+	if !found {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "could not expand home directory")
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// loadSSHSigner reads a private key, decrypting it with passphrase if it is encrypted.
+func loadSSHSigner(path string, passphrase string, hasPassphrase bool) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read ssh identity file: %s", path)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) && hasPassphrase {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse ssh identity file: %s", path)
+	}
+	return signer, nil
+}
+
+// configure applies the SSH configuration of a proxy hop.
+func (d *sshDialer) configure(cfg config.SSHConfig) error {
+	passphrase, hasPassphrase := d.user.Password()
+
+	// Configured identity files must exist, the defaults are skipped if missing.
+	identityFiles, required := cfg.IdentityFiles, true
+	if len(identityFiles) == 0 {
+		identityFiles, required = defaultSSHIdentityFiles, false
+	}
+	for _, identityFile := range identityFiles {
+		path, err := expandHome(identityFile)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); !required && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		signer, err := loadSSHSigner(path, passphrase, hasPassphrase)
+		if err != nil {
+			return err
+		}
+		d.signers = append(d.signers, signer)
+	}
+
+	if cfg.Agent == nil || *cfg.Agent {
+		d.agentSocket = os.Getenv("SSH_AUTH_SOCK")
+	}
+
+	if len(d.signers) == 0 && d.agentSocket == "" && !hasPassphrase {
+		return errors.Wrapf(ErrSSHNoAuthMethods, "%s", d.sshAddr)
+	}
+
+	if cfg.NoVerify {
+		//nolint:gosec
+		d.hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		knownHostsFiles := cfg.KnownHosts
+		if len(knownHostsFiles) == 0 {
+			knownHostsFiles = []string{"~/.ssh/known_hosts"}
+		}
+		paths := make([]string, 0, len(knownHostsFiles))
+		for _, knownHostsFile := range knownHostsFiles {
+			path, err := expandHome(knownHostsFile)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+		callback, err := knownhosts.New(paths...)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return errors.Wrapf(ErrSSHNoKnownHosts, "%v", err)
+			}
+			return errors.Wrap(err, "could not load known_hosts")
+		}
+		d.hostKeyCallback = callback
+	}
+
+	if cfg.KeepaliveInterval != 0 {
+		d.keepaliveInterval = cfg.KeepaliveInterval
+	}
+	return nil
+}
+
+// session returns the shared SSH session, connecting it if needed.
+func (d *sshDialer) session(ctx context.Context) (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	conn, err := dialForward(ctx, d.forward, "tcp", d.sshAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ssh: failed dialing %s", d.sshAddr)
+	}
+
+	authMethods := []ssh.AuthMethod{}
+	if len(d.signers) > 0 {
+		authMethods = append(authMethods, ssh.PublicKeys(d.signers...))
+	}
+	if d.agentSocket != "" {
+		agentConn, err := net.Dial("unix", d.agentSocket)
+		if err != nil {
+			d.logger.Warn("Could not connect to SSH agent", zap.String("agent_socket", d.agentSocket), zap.Error(err))
+		} else {
+			defer agentConn.Close()
+			authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+	if password, hasPassword := d.user.Password(); hasPassword {
+		authMethods = append(authMethods, ssh.Password(password))
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            d.user.Username(),
+		Auth:            authMethods,
+		HostKeyCallback: d.hostKeyCallback,
+	}
+
+	// Abort the handshake if the context is cancelled.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, d.sshAddr, clientConfig)
+	if !stop() && err == nil {
+		err = ctx.Err()
+		_ = sshConn.Close()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "ssh: handshake with %s failed", d.sshAddr)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	d.client = client
+	d.logger.Debug("SSH session opened")
+
+	done := make(chan struct{})
+	go d.keepalive(client, done)
+	go func() {
+		err := client.Wait()
+		close(done)
+		d.mu.Lock()
+		if d.client == client {
+			d.client = nil
+		}
+		d.mu.Unlock()
+		d.logger.Debug("SSH session closed", zap.Error(err))
+	}()
+
+	return client, nil
+}
+
+// keepalive closes the session if the SSH host stops responding.
+func (d *sshDialer) keepalive(client *ssh.Client, done <-chan struct{}) {
+	ticker := time.NewTicker(d.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		select {
+		case err := <-replied:
+			if err == nil {
+				continue
+			}
+			d.logger.Warn("SSH keepalive failed", zap.Error(err))
+		case <-time.After(d.keepaliveInterval):
+			d.logger.Warn("SSH keepalive timed out")
+		}
+		_ = client.Close()
+		return
+	}
+}
+
+// reset closes client if it is still the shared session.
+func (d *sshDialer) reset(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	_ = client.Close()
+}
+
+// Dial implements proxy.Dialer.
+func (d *sshDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer. If the shared session has been
+// lost the channel is retried once on a new session.
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.Errorf("ssh: network type %q unsupported", network)
+	}
+
+	for attempt := 0; ; attempt++ {
+		client, err := d.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := client.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		// The SSH host refused the channel, so the session is still good.
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) || ctx.Err() != nil || attempt > 0 {
+			return nil, errors.Wrapf(err, "ssh: %s failed to connect to %s", d.sshAddr, addr)
+		}
+		d.logger.Debug("SSH session lost, reconnecting", zap.Error(err))
+		d.reset(client)
+	}
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/proxyreverse/pkg/server/config"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrClientHelloPeeked       = errors.New("client hello peeked")
+	ErrListenerAlreadyHasSite  = errors.New("listener only supports a single site")
+	ErrSiteBackendTargetNeeded = errors.New("site backend must specify a target host and port")
+)
+
+// closeWriter is implemented by connections which support half-closing.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies data bidirectionally between the client and backend connections
+// until both directions are finished. When one side finishes sending, the write
+// side of the other connection is half-closed if possible so protocols which
+// depend on half-close keep working. Connections which can't be half-closed,
+// such as those through an environment proxy hop, are closed instead. If idle
+// is positive both connections are closed once no data has been copied in
+// either direction for that long. The bytes received from and sent to the
+// client are returned.
+func splice(logger *zap.Logger, client net.Conn, backend net.Conn, idle time.Duration) (int64, int64) {
+	var wg sync.WaitGroup
+	var bytesIn, bytesOut int64
+	startTime := time.Now()
+
+	var tracker *idleTracker
+	if idle > 0 {
+		tracker = newIdleTracker(idle)
+		done := make(chan struct{})
+		defer close(done)
+		go tracker.watch(done, func() {
+			logger.Debug("Connection idle timeout", zap.Duration("idle", idle))
+			_ = client.Close()
+			_ = backend.Close()
+		})
+	}
+
+	pump := func(dst net.Conn, src net.Conn, count *int64, direction string) {
+		defer wg.Done()
+		var reader io.Reader = src
+		if tracker != nil {
+			reader = &activityReader{reader: src, tracker: tracker}
+		}
+		n, err := io.Copy(dst, reader)
+		*count = n
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Debug("Error while copying connection data", zap.String("direction", direction), zap.Error(err))
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go pump(backend, client, &bytesIn, "in")
+	go pump(client, backend, &bytesOut, "out")
+	wg.Wait()
+
+	_ = client.Close()
+	_ = backend.Close()
+
+	logger.Info("Connection closed", zap.Int64("bytes_in", bytesIn), zap.Int64("bytes_out", bytesOut),
+		zap.Duration("duration", time.Since(startTime)))
+	return bytesIn, bytesOut
+}
+
+// streamListener accepts raw connections for the stream listener types.
+type streamListener struct {
+	logger      *zap.Logger
+	name        string
+	key         listenerKey
+	metrics     *serverMetrics
+	idleTimeout time.Duration // idleTimeout closes spliced connections with no traffic if it is positive
+	listener    *closeNotifyListener
+}
+
+// start accepts connections on inherited, or on the listener address if
+// inherited is nil, and passes them to handle until ctx is cancelled or the
+// listener is closed.
+func (l *streamListener) start(ctx context.Context, inherited net.Listener, handle func(conn net.Conn)) error {
+	listener, err := listenOrInherit(l.logger, l.key, inherited)
+	if err != nil {
+		return err
+	}
+	l.listener = listener
+	gauge := activeConnectionsGauge(l.name)
+	serveStream(ctx, l.logger, l.listener, func(conn net.Conn) {
+		gauge.Inc()
+		defer gauge.Dec()
+		handle(conn)
+	})
+	return nil
+}
+
+// socket implements managedListener.
+func (l *streamListener) socket() net.Listener {
+	if l.listener == nil {
+		return nil
+	}
+	return l.listener.Listener
+}
+
+// Close implements Listener. Connections which are already spliced to a backend
+// are not affected.
+func (l *streamListener) Close() error {
+	if l.listener == nil {
+		return nil
+	}
+	l.logger.Info("Stream listener shutdown")
+	if err := l.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return errors.Wrap(err, "failed to close stream listener")
+	}
+	return nil
+}
+
+// serveStream accepts connections on listener and passes them to handle until
+// the context is cancelled or the listener is closed.
+func serveStream(ctx context.Context, logger *zap.Logger, listener *closeNotifyListener, handle func(conn net.Conn)) {
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-listener.closed:
+			return
+		}
+		logger.Info("Stream listener shutdown")
+		if err := listener.Close(); err != nil {
+			logger.Error("Got error while closing stream listener", zap.Error(err))
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					logger.Info("Listener closed")
+					return
+				}
+				logger.Error("Error accepting connection", zap.Error(err))
+				continue
+			}
+			go handle(conn)
+		}
+	}()
+}
+
+// readOnlyConn is a net.Conn which can only be read from. It is used to run the
+// TLS server handshake far enough to parse the ClientHello.
+type readOnlyConn struct {
+	reader io.Reader
+	net.Conn
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c readOnlyConn) Write(_ []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
+
+// peekedConn replays data which was read while peeking before continuing to
+// read from the underlying connection.
+type peekedConn struct {
+	reader io.Reader
+	net.Conn
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+// CloseWrite implements closeWriter if the underlying connection does.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// peekClientHello reads the TLS ClientHello from conn without consuming it. The
+// returned connection will replay the ClientHello to the next reader.
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	peeked := new(bytes.Buffer)
+	var hello *tls.ClientHelloInfo
+
+	//nolint:gosec
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, peeked), Conn: conn}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *info
+			return nil, ErrClientHelloPeeked
+		},
+	}).Handshake()
+
+	replayConn := &peekedConn{reader: io.MultiReader(peeked, conn), Conn: conn}
+	if hello == nil {
+		return nil, replayConn, errors.Wrap(err, "could not read TLS ClientHello")
+	}
+
+	return hello, replayConn, nil
+}
+
+// TLSPassthroughListener routes TLS connections to sites by the SNI name in
+// the ClientHello without terminating TLS.
+type TLSPassthroughListener struct {
+	streamListener
+	port               uint16
+	clientHelloTimeout time.Duration // clientHelloTimeout is the time allowed to read the ClientHello
+
+	mu     sync.Mutex // mu serializes changes to the sites
+	sites  []*Site
+	routes atomic.Pointer[matcher[*Site]]
+}
+
+// setSitesLocked replaces the sites. l.mu must be held.
+func (l *TLSPassthroughListener) setSitesLocked(sites []*Site) {
+	routes := newMatcher[*Site]()
+	for _, site := range sites {
+		if routes.add(site.Host, site) {
+			l.logger.Warn("Site backend already exists but is being overridden", zap.String("host", site.Host))
+		}
+	}
+	l.sites = sites
+	l.routes.Store(routes)
+}
+
+// AddSite implements Listener.
+func (l *TLSPassthroughListener) AddSite(site *Site) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setSitesLocked(append(append([]*Site{}, l.sites...), site))
+	return nil
+}
+
+// SetSites implements Listener.
+func (l *TLSPassthroughListener) SetSites(sites []*Site) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setSitesLocked(append([]*Site{}, sites...))
+	return nil
+}
+
+// RemoveSite implements Listener.
+func (l *TLSPassthroughListener) RemoveSite(host string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sites := lo.Reject(l.sites, func(site *Site, _ int) bool { return site.Host == host })
+	if len(sites) == len(l.sites) {
+		return errors.Wrapf(ErrSiteNotFound, "%v", host)
+	}
+	l.sites = sites
+	l.routes.Store(l.routes.Load().without(host))
+	return nil
+}
+
+// handleConn peeks the SNI name and splices the connection to the site backend.
+func (l *TLSPassthroughListener) handleConn(conn net.Conn) {
+	logger := l.logger.With(zap.String("remote_addr", conn.RemoteAddr().String()))
+
+	if l.clientHelloTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(l.clientHelloTimeout))
+	}
+	hello, conn, err := peekClientHello(conn)
+	if err != nil {
+		logger.Debug("Failed to read ClientHello", zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	logger = logger.With(zap.String("server_name", hello.ServerName))
+
+	if hello.ServerName == "" {
+		logger.Debug("Client did not send SNI")
+		_ = conn.Close()
+		return
+	}
+
+	site, found := l.routes.Load().match(hello.ServerName)
+	if !found {
+		logger.Debug("Host is not known")
+		_ = conn.Close()
+		return
+	}
+
+	targetHost := site.Config.Backend.Target.Host
+	if targetHost == "" {
+		targetHost = hello.ServerName
+	}
+	targetPort := site.Config.Backend.Target.Port
+	if targetPort == 0 {
+		targetPort = l.port
+	}
+	target := net.JoinHostPort(targetHost, strconv.FormatUint(uint64(targetPort), 10))
+	logger = logger.With(zap.String("target", target))
+
+	dialCtx, cancel := withTimeout(context.Background(), site.Config.Backend.Timeouts.Connect)
+	backend, err := site.Proxychain.Dialer().DialContext(dialCtx, "tcp", target)
+	cancel()
+	if err != nil {
+		logger.Info("Error contacting backend", zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+
+	logger.Info("Connection opened")
+	bytesIn, bytesOut := splice(logger, conn, backend, l.idleTimeout)
+	l.metrics.addBytes(l.name, site, bytesIn, bytesOut)
+}
+
+// newTLSPassthroughListener initializes a TLSPassthroughListener without starting it.
+func newTLSPassthroughListener(name string, cfg listenerKey, timeouts config.ListenerTimeouts,
+	metrics *serverMetrics,
+) *TLSPassthroughListener {
+	r := &TLSPassthroughListener{
+		streamListener: streamListener{
+			logger:      zap.L().With(zap.String("addr", cfg.Addr.String()), zap.String("network", cfg.Network)),
+			name:        name,
+			key:         cfg,
+			metrics:     metrics,
+			idleTimeout: enabledTimeout(timeouts.Idle),
+		},
+		port:               cfg.Addr.Port(),
+		clientHelloTimeout: timeouts.ReadHeader,
+	}
+	r.setSitesLocked(nil)
+	return r
+}
+
+// start starts accepting connections on inherited, or on the listener address
+// if inherited is nil.
+func (l *TLSPassthroughListener) start(ctx context.Context, inherited net.Listener) error {
+	return l.streamListener.start(ctx, inherited, l.handleConn)
+}
+
+// TCPForwardListener forwards every connection it accepts to the backend target
+// of its single site.
+type TCPForwardListener struct {
+	streamListener
+	site atomic.Pointer[Site]
+}
+
+// validateTCPForwardSite checks site has a fixed backend target.
+func validateTCPForwardSite(site *Site) error {
+	if site.Config.Backend.Target.Host == "" || site.Config.Backend.Target.Port == 0 {
+		return errors.Wrapf(ErrSiteBackendTargetNeeded, "%v", site.Host)
+	}
+	return nil
+}
+
+// AddSite implements Listener.
+func (l *TCPForwardListener) AddSite(site *Site) error {
+	if err := validateTCPForwardSite(site); err != nil {
+		return err
+	}
+	if !l.site.CompareAndSwap(nil, site) {
+		return errors.Wrapf(ErrListenerAlreadyHasSite, "%v", site.Host)
+	}
+	return nil
+}
+
+// SetSites implements Listener.
+func (l *TCPForwardListener) SetSites(sites []*Site) error {
+	if len(sites) > 1 {
+		return errors.Wrapf(ErrListenerAlreadyHasSite, "%v", sites[1].Host)
+	}
+	if len(sites) == 0 {
+		l.site.Store(nil)
+		return nil
+	}
+	if err := validateTCPForwardSite(sites[0]); err != nil {
+		return err
+	}
+	l.site.Store(sites[0])
+	return nil
+}
+
+// RemoveSite implements Listener.
+func (l *TCPForwardListener) RemoveSite(host string) error {
+	site := l.site.Load()
+	if site == nil || site.Host != host || !l.site.CompareAndSwap(site, nil) {
+		return errors.Wrapf(ErrSiteNotFound, "%v", host)
+	}
+	return nil
+}
+
+// handleConn dials the site backend and splices the connection to it.
+func (l *TCPForwardListener) handleConn(conn net.Conn) {
+	logger := l.logger.With(zap.String("remote_addr", conn.RemoteAddr().String()))
+
+	site := l.site.Load()
+	if site == nil {
+		logger.Debug("No site attached to listener")
+		_ = conn.Close()
+		return
+	}
+
+	target := site.Config.Backend.Target.HostPort()
+	logger = logger.With(zap.String("target", target))
+
+	dialCtx, cancel := withTimeout(context.Background(), site.Config.Backend.Timeouts.Connect)
+	backend, err := site.Proxychain.Dialer().DialContext(dialCtx, "tcp", target)
+	cancel()
+	if err != nil {
+		logger.Info("Error contacting backend", zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+
+	logger.Info("Connection opened")
+	bytesIn, bytesOut := splice(logger, conn, backend, l.idleTimeout)
+	l.metrics.addBytes(l.name, site, bytesIn, bytesOut)
+}
+
+// newTCPForwardListener initializes a TCPForwardListener without starting it.
+func newTCPForwardListener(name string, cfg listenerKey, timeouts config.ListenerTimeouts,
+	metrics *serverMetrics,
+) *TCPForwardListener {
+	return &TCPForwardListener{
+		streamListener: streamListener{
+			logger:      zap.L().With(zap.String("addr", cfg.Addr.String()), zap.String("network", cfg.Network)),
+			name:        name,
+			key:         cfg,
+			metrics:     metrics,
+			idleTimeout: enabledTimeout(timeouts.Idle),
+		},
+	}
+}
+
+// start starts accepting connections on inherited, or on the listener address
+// if inherited is nil.
+func (l *TCPForwardListener) start(ctx context.Context, inherited net.Listener) error {
+	return l.streamListener.start(ctx, inherited, l.handleConn)
+}
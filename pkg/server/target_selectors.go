@@ -1,24 +1,43 @@
 package server
 
 import (
+	"cmp"
+	"context"
 	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
 	"net"
 	"net/http"
-	"path"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
 	"github.com/wrouesnel/proxyreverse/pkg/server/config"
 	"go.uber.org/zap"
 )
 
+var (
+	ErrUnknownBalancePolicy = errors.New("unknown load balancing policy")
+	ErrNoBalanceTargets     = errors.New("load balancing requires at least one entry in targets")
+)
+
 // TargetSelector implements determining the target backend for an HTTP edge proxy.
 type TargetSelector interface {
 	// GetTarget returns the target
 	GetTarget(backend HTTPBackend, request *http.Request) string
 }
 
+// PathMapper is implemented by selectors which modify the request path, so that
+// backend paths in responses can be mapped back to public paths.
+type PathMapper interface {
+	// PublicPath maps backendPath to the public path given the original request path.
+	PublicPath(originalPath string, backendPath string) string
+}
+
 // DefaultSelector logic implements the default (not specificed) selector. Namely
 // if the backend does not include a specific Host to target, then the Host on the
 // incoming request is used.
@@ -61,14 +80,247 @@ func (p PathIndexSelector) GetTarget(backend HTTPBackend, request *http.Request)
 
 	target := fmt.Sprintf("%s:%v", targetHost, targetPort)
 
-	// Edit the URL in place
+	// Edit the URL in place. The parts are joined as they are, since path.Join
+	// would drop the leading and trailing slashes.
 	modifiedPathParts := slices.Delete(pathParts, p.Index, p.Index+1)
-	request.URL.Path = path.Join(modifiedPathParts...)
+	request.URL.Path = strings.Join(modifiedPathParts, "/")
 
 	return target
 }
 
-func NewTargetSelector(name config.TargetSelectType, parameters map[string]interface{}) TargetSelector {
+// PublicPath implements PathMapper by re-inserting the host path component.
+func (p PathIndexSelector) PublicPath(originalPath string, backendPath string) string {
+	originalParts := strings.Split(originalPath, "/")
+	if len(originalParts) < p.Index+1 {
+		return backendPath
+	}
+
+	backendParts := strings.Split(backendPath, "/")
+	if len(backendParts) < p.Index {
+		return backendPath
+	}
+
+	publicParts := slices.Insert(backendParts, p.Index, originalParts[p.Index])
+	return strings.Join(publicParts, "/")
+}
+
+type excludedTargetsKey struct{}
+
+// withExcludedTargets returns a context which asks selectors to avoid targets
+// which have already been tried for the request.
+func withExcludedTargets(ctx context.Context, targets []string) context.Context {
+	return context.WithValue(ctx, excludedTargetsKey{}, targets)
+}
+
+// excludedTargets returns the targets which should be avoided for the request.
+func excludedTargets(ctx context.Context) []string {
+	targets, _ := ctx.Value(excludedTargetsKey{}).([]string)
+	return targets
+}
+
+// TargetReleaser is implemented by selectors which track in-flight requests. It
+// is called with the value returned by GetTarget once the request is finished.
+type TargetReleaser interface {
+	ReleaseTarget(target string)
+}
+
+type BalancePolicy string
+
+const (
+	BalancePolicyRoundRobin       BalancePolicy = "round-robin"
+	BalancePolicyLeastConnections BalancePolicy = "least-connections"
+	BalancePolicyRandom           BalancePolicy = "random"
+	BalancePolicyHash             BalancePolicy = "hash"
+)
+
+// hashRingReplicas is the number of points each unit of weight occupies on the
+// consistent hash ring.
+const hashRingReplicas = 100
+
+// balancedTarget tracks the load balancing state of a single target.
+type balancedTarget struct {
+	addr          string
+	weight        int
+	currentWeight int          // currentWeight is the smooth weighted round-robin state
+	active        atomic.Int64 // active is the number of in-flight requests
+}
+
+type hashRingEntry struct {
+	hash   uint64
+	target *balancedTarget
+}
+
+// BalancedSelector spreads requests across the list of backend targets according
+// to a load balancing policy. The hash policy hashes the value of HashHeader, or
+// the client IP if the header is not set or not present.
+type BalancedSelector struct {
+	Policy     BalancePolicy `mapstructure:"policy"`      // Policy is the load balancing policy
+	HashHeader string        `mapstructure:"hash_header"` // HashHeader is the request header hashed by the hash policy
+
+	mu      sync.Mutex
+	targets []*balancedTarget
+	ring    []hashRingEntry
+}
+
+// init builds the selector state from the configured targets.
+func (b *BalancedSelector) init(targets []config.WeightedTarget) error {
+	switch b.Policy {
+	case "":
+		b.Policy = BalancePolicyRoundRobin
+	case BalancePolicyRoundRobin, BalancePolicyLeastConnections, BalancePolicyRandom, BalancePolicyHash:
+	default:
+		return errors.Wrapf(ErrUnknownBalancePolicy, "%v", b.Policy)
+	}
+
+	if len(targets) == 0 {
+		return ErrNoBalanceTargets
+	}
+
+	for _, target := range targets {
+		weight := int(target.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		b.targets = append(b.targets, &balancedTarget{addr: target.Target.HostPort(), weight: weight})
+	}
+
+	for _, target := range b.targets {
+		for i := 0; i < target.weight*hashRingReplicas; i++ {
+			b.ring = append(b.ring, hashRingEntry{hash: hashString(fmt.Sprintf("%s#%d", target.addr, i)), target: target})
+		}
+	}
+	slices.SortFunc(b.ring, func(a, b hashRingEntry) int { return cmp.Compare(a.hash, b.hash) })
+
+	return nil
+}
+
+// available returns the targets which are currently healthy, whose circuit is not
+// open and which have not already been tried. If no targets are available then
+// all targets are returned so requests
+// still have somewhere to go, and if all healthy targets have been tried they
+// may be used again.
+func (b *BalancedSelector) available(backend HTTPBackend, excluded []string) []*balancedTarget {
+	healthy := lo.Filter(b.targets, func(t *balancedTarget, _ int) bool {
+		return backend.health.Healthy(t.addr) && backend.breakers.Get(t.addr).Ready()
+	})
+	if len(healthy) == 0 {
+		healthy = b.targets
+	}
+	untried := lo.Filter(healthy, func(t *balancedTarget, _ int) bool { return !slices.Contains(excluded, t.addr) })
+	if len(untried) == 0 {
+		return healthy
+	}
+	return untried
+}
+
+// GetTarget implements TargetSelector.
+func (b *BalancedSelector) GetTarget(backend HTTPBackend, request *http.Request) string {
+	targets := b.available(backend, excludedTargets(request.Context()))
+
+	var selected *balancedTarget
+	switch b.Policy {
+	case BalancePolicyLeastConnections:
+		selected = b.leastConnections(targets)
+	case BalancePolicyRandom:
+		selected = b.random(targets)
+	case BalancePolicyHash:
+		selected = b.hash(request, targets)
+	default:
+		selected = b.roundRobin(targets)
+	}
+
+	selected.active.Add(1)
+	return selected.addr
+}
+
+// ReleaseTarget implements TargetReleaser.
+func (b *BalancedSelector) ReleaseTarget(target string) {
+	for _, t := range b.targets {
+		if t.addr == target {
+			t.active.Add(-1)
+			return
+		}
+	}
+}
+
+// roundRobin implements smooth weighted round-robin.
+func (b *BalancedSelector) roundRobin(targets []*balancedTarget) *balancedTarget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	totalWeight := 0
+	var selected *balancedTarget
+	for _, target := range targets {
+		target.currentWeight += target.weight
+		totalWeight += target.weight
+		if selected == nil || target.currentWeight > selected.currentWeight {
+			selected = target
+		}
+	}
+	selected.currentWeight -= totalWeight
+	return selected
+}
+
+// leastConnections selects the target with the fewest in-flight requests relative
+// to its weight.
+func (b *BalancedSelector) leastConnections(targets []*balancedTarget) *balancedTarget {
+	var selected *balancedTarget
+	for _, target := range targets {
+		if selected == nil ||
+			target.active.Load()*int64(selected.weight) < selected.active.Load()*int64(target.weight) {
+			selected = target
+		}
+	}
+	return selected
+}
+
+// random selects a target at random in proportion to its weight.
+func (b *BalancedSelector) random(targets []*balancedTarget) *balancedTarget {
+	totalWeight := 0
+	for _, target := range targets {
+		totalWeight += target.weight
+	}
+	//nolint:gosec
+	pick := rand.IntN(totalWeight)
+	for _, target := range targets {
+		if pick < target.weight {
+			return target
+		}
+		pick -= target.weight
+	}
+	return targets[len(targets)-1]
+}
+
+// hash selects a target from the consistent hash ring. The ring is walked until
+// one of targets is found.
+func (b *BalancedSelector) hash(request *http.Request, targets []*balancedTarget) *balancedTarget {
+	key := ""
+	if b.HashHeader != "" {
+		key = request.Header.Get(b.HashHeader)
+	}
+	if key == "" {
+		key, _, _ = net.SplitHostPort(request.RemoteAddr)
+	}
+
+	keyHash := hashString(key)
+	idx, _ := slices.BinarySearchFunc(b.ring, keyHash, func(e hashRingEntry, h uint64) int { return cmp.Compare(e.hash, h) })
+	for i := 0; i < len(b.ring); i++ {
+		entry := b.ring[(idx+i)%len(b.ring)]
+		if slices.Contains(targets, entry.target) {
+			return entry.target
+		}
+	}
+	return b.ring[idx%len(b.ring)].target
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func NewTargetSelector(name config.TargetSelectType, parameters map[string]interface{},
+	targets []config.WeightedTarget) TargetSelector {
 	logger := zap.L().With(zap.String("target_select", string(name)))
 
 	switch name {
@@ -96,6 +348,22 @@ func NewTargetSelector(name config.TargetSelectType, parameters map[string]inter
 			return nil
 		}
 		return selector
+	case config.TargetSelectTypeBalance:
+		selector := new(BalancedSelector)
+		decoder, err := config.Decoder(selector, false)
+		if err != nil {
+			logger.Error("Error building decoder", zap.Error(err))
+			return nil
+		}
+		if err := decoder.Decode(parameters); err != nil {
+			logger.Error("Error while decoding parameters for selector", zap.Error(err))
+			return nil
+		}
+		if err := selector.init(targets); err != nil {
+			logger.Error("Error while initializing selector", zap.Error(err))
+			return nil
+		}
+		return selector
 	default:
 		logger.Error("Unknown target selector requested")
 		return nil
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathIndexSelectorKeepsSlashes(t *testing.T) {
+	selector := PathIndexSelector{Index: 1}
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/backend.internal:8080/app/", "/app/"},
+		{"/backend.internal:8080/app/index.html", "/app/index.html"},
+		{"/backend.internal:8080/", "/"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		selector.GetTarget(HTTPBackend{}, request)
+		if request.URL.Path != tc.expected {
+			t.Errorf("%s: expected backend path %q, got %q", tc.path, tc.expected, request.URL.Path)
+		}
+		if public := selector.PublicPath(tc.path, request.URL.Path); public != tc.path {
+			t.Errorf("%s: expected the public path to round trip, got %q", tc.path, public)
+		}
+	}
+}
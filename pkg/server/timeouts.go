@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// enabledTimeout returns timeout, or zero if the timeout is disabled.
+func enabledTimeout(timeout time.Duration) time.Duration {
+	if timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
+// withTimeout returns ctx bounded by timeout, or ctx unchanged if the timeout
+// is disabled.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutDialer bounds each dial of dialer by timeout.
+type timeoutDialer struct {
+	dialer  proxy.Dialer
+	timeout time.Duration
+}
+
+// newTimeoutDialer wraps dialer with timeout, or returns dialer if the timeout
+// is disabled.
+func newTimeoutDialer(dialer proxy.Dialer, timeout time.Duration) proxy.Dialer {
+	if timeout <= 0 {
+		return dialer
+	}
+	return &timeoutDialer{dialer: dialer, timeout: timeout}
+}
+
+// Dial implements proxy.Dialer.
+func (d *timeoutDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer.
+func (d *timeoutDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return dialForward(ctx, d.dialer, network, addr)
+}
+
+// backendErrorStatus returns the status sent to the client when the backend
+// could not be contacted.
+func backendErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// idleTracker records when data last passed through a spliced connection in
+// either direction.
+type idleTracker struct {
+	timeout    time.Duration
+	lastActive atomic.Int64
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	t := &idleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+// touch records activity now.
+func (t *idleTracker) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long there has been no activity.
+func (t *idleTracker) idleFor() time.Duration {
+	return time.Since(time.Unix(0, t.lastActive.Load()))
+}
+
+// watch calls onIdle once there has been no activity for the timeout, unless
+// done is closed first. Deadlines aren't used since not every proxychain
+// connection supports them.
+func (t *idleTracker) watch(done <-chan struct{}, onIdle func()) {
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			if idleFor := t.idleFor(); idleFor < t.timeout {
+				timer.Reset(t.timeout - idleFor)
+				continue
+			}
+			onIdle()
+			return
+		}
+	}
+}
+
+// activityReader records reads from reader as activity on tracker.
+type activityReader struct {
+	reader  io.Reader
+	tracker *idleTracker
+}
+
+// Read implements io.Reader.
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.tracker.touch()
+	}
+	return n, err //nolint:wrapcheck
+}
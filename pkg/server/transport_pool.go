@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxTransports        = 64
+	defaultTransportIdleTimeout = 90 * time.Second
+)
+
+// transportKey identifies a transport by the backend address and the TLS
+// server name it is dialed with.
+type transportKey struct {
+	Addr       string
+	ServerName string
+}
+
+type transportEntry struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+// transportPool caches HTTP transports per target and SNI name so connections
+// can be reused without sharing mutable TLS configuration between requests.
+type transportPool struct {
+	mu        sync.Mutex
+	entries   map[transportKey]*transportEntry
+	lastSweep time.Time
+
+	maxSize      int
+	idleTimeout  time.Duration
+	newTransport func(key transportKey) *http.Transport
+}
+
+// newTransportPool initializes a pool. Zero values for maxSize and idleTimeout
+// select the defaults.
+func newTransportPool(maxSize int, idleTimeout time.Duration,
+	newTransport func(key transportKey) *http.Transport) *transportPool {
+	if maxSize <= 0 {
+		maxSize = defaultMaxTransports
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTransportIdleTimeout
+	}
+	return &transportPool{
+		entries:      make(map[transportKey]*transportEntry),
+		lastSweep:    time.Now(),
+		maxSize:      maxSize,
+		idleTimeout:  idleTimeout,
+		newTransport: newTransport,
+	}
+}
+
+// Get returns the transport for key, creating it if needed.
+func (p *transportPool) Get(key transportKey) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.lastSweep) > p.idleTimeout {
+		p.evictIdle(now)
+	}
+
+	if entry, found := p.entries[key]; found {
+		entry.lastUsed = now
+		return entry.transport
+	}
+
+	if len(p.entries) >= p.maxSize {
+		p.evictOldest()
+	}
+
+	transport := p.newTransport(key)
+	transport.IdleConnTimeout = p.idleTimeout
+	p.entries[key] = &transportEntry{transport: transport, lastUsed: now}
+	return transport
+}
+
+// evictIdle removes transports which have not been used within the idle timeout.
+// Must be called with the lock held.
+func (p *transportPool) evictIdle(now time.Time) {
+	for key, entry := range p.entries {
+		if now.Sub(entry.lastUsed) > p.idleTimeout {
+			entry.transport.CloseIdleConnections()
+			delete(p.entries, key)
+		}
+	}
+	p.lastSweep = now
+}
+
+// evictOldest removes the least recently used transport. In-flight requests on
+// the transport complete normally. Must be called with the lock held.
+func (p *transportPool) evictOldest() {
+	var oldestKey transportKey
+	var oldest *transportEntry
+	for key, entry := range p.entries {
+		if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if oldest != nil {
+		oldest.transport.CloseIdleConnections()
+		delete(p.entries, oldestKey)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+)
+
+// isUpgradeRequest returns true if the client is requesting a protocol switch
+// such as a WebSocket connection.
+func isUpgradeRequest(request *http.Request) bool {
+	return request.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(request.Header.Values("Connection"), "upgrade")
+}
+
+// dialBackend connects to the backend address via the proxychain, performing
+// the TLS handshake if the backend requires it.
+func (h HTTPBackend) dialBackend(request *http.Request, addr string, targetHost string) (net.Conn, error) {
+	conn, err := h.dialContext(request.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !h.tls.Enable {
+		return conn, nil
+	}
+
+	tlsConfig := h.tlsConfig.Clone()
+	if h.target == "" && h.tls.ServerNameIndication == nil {
+		tlsConfig.ServerName = targetHost
+	}
+	// Upgraded connections can only be spoken over HTTP/1.1
+	tlsConfig.NextProtos = []string{"http/1.1"}
+
+	ctx, cancel := withTimeout(request.Context(), h.timeouts.TLSHandshake)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// serveUpgrade forwards a protocol upgrade handshake to the backend. If the
+// backend agrees to switch protocols the client connection is hijacked and
+// bytes are pumped in both directions until either side closes.
+func (h HTTPBackend) serveUpgrade(writer http.ResponseWriter, request *http.Request, headers http.Header,
+	outboundURL *url.URL, targetHost string) {
+	logger := h.logger.With(zap.String("upgrade", request.Header.Get("Upgrade")),
+		zap.String("target_addr", outboundURL.Host))
+
+	breaker := h.breakers.Get(outboundURL.Host)
+	if err := breaker.Allow(); err != nil {
+		logger.Debug("Circuit breaker is open", zap.Error(err))
+		writeCircuitOpenPage(writer, breaker.RetryAfter())
+		return
+	}
+
+	backendConn, err := h.dialBackend(request, outboundURL.Host, targetHost)
+	if err != nil {
+		logger.Debug("Error contacting backend", zap.Error(err))
+		if errors.Is(err, ErrCircuitOpen) {
+			// A proxy in the chain is failing, not the backend.
+			breaker.Release()
+			writeCircuitOpenPage(writer, 0)
+			return
+		}
+		if errors.Is(request.Context().Err(), context.Canceled) {
+			breaker.Release()
+		} else {
+			h.health.ReportFailure(outboundURL.Host)
+			breaker.Failure()
+		}
+		writer.WriteHeader(backendErrorStatus(err))
+		return
+	}
+	breaker.Success()
+
+	outbound := request.Clone(request.Context())
+	outbound.URL = outboundURL
+	outbound.RequestURI = ""
+	outbound.Header = headers
+	outbound.Host = headers.Get("Host")
+
+	if err := outbound.Write(backendConn); err != nil {
+		logger.Debug("Error writing upgrade request to backend", zap.Error(err))
+		_ = backendConn.Close()
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	if timeout := h.timeouts.ResponseHeader; timeout > 0 {
+		_ = backendConn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, outbound)
+	if err != nil {
+		logger.Debug("Error reading upgrade response from backend", zap.Error(err))
+		_ = backendConn.Close()
+		writer.WriteHeader(backendErrorStatus(err))
+		return
+	}
+	_ = backendConn.SetReadDeadline(time.Time{})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Backend refused the upgrade - pass the response through as normal.
+		defer backendConn.Close()
+		defer resp.Body.Close()
+		removeHopByHopHeaders(resp.Header)
+		headerMap := writer.Header()
+		for k, v := range resp.Header {
+			headerMap[k] = v
+		}
+		writer.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(writer, resp.Body)
+		return
+	}
+
+	clientConn, clientBuf, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		logger.Error("Could not hijack client connection for upgrade", zap.Error(err))
+		_ = backendConn.Close()
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := resp.Write(clientConn); err != nil {
+		logger.Debug("Error writing upgrade response to client", zap.Error(err))
+		_ = clientConn.Close()
+		_ = backendConn.Close()
+		return
+	}
+
+	logger.Info("Connection upgraded")
+	rm := requestMetricsFrom(request.Context())
+	rm.upgradeOpened()
+	// Data may already be buffered on either side so read through the buffers.
+	bytesIn, bytesOut := splice(logger, &peekedConn{reader: clientBuf.Reader, Conn: clientConn},
+		&peekedConn{reader: backendReader, Conn: backendConn}, 0)
+	rm.upgradeClosed(bytesIn, bytesOut)
+}